@@ -2,16 +2,22 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"go-microservices-observability/internal/adapters/queue"
 	inventory2 "go-microservices-observability/internal/adapters/repository/inventory"
 	"go-microservices-observability/internal/adapters/repository/order"
+	"go-microservices-observability/internal/adapters/repository/sqldb"
+	userRepo "go-microservices-observability/internal/adapters/repository/user"
+	inventory_rest "go-microservices-observability/internal/adapters/rest/inventory"
 	order_rest "go-microservices-observability/internal/adapters/rest/order"
 	user_rest "go-microservices-observability/internal/adapters/rest/user"
 	"go-microservices-observability/internal/adapters/user"
+	"go-microservices-observability/internal/auth"
 	"go-microservices-observability/internal/services/inventory"
 	"go-microservices-observability/internal/services/notification"
 	order_service "go-microservices-observability/internal/services/order"
+	user_service "go-microservices-observability/internal/services/user"
 	"go-microservices-observability/pkg/diagnostics"
 	"go-microservices-observability/pkg/tracing"
 	"log"
@@ -25,6 +31,13 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+const (
+	consumerWorkers     = 4
+	maxInFlightMessages = 100
+	// tokenIssuer is the issuer of the tokens of the user service, which the order API accepts.
+	tokenIssuer = "user-service"
+)
+
 func main() {
 	orderServiceExporter, err := otlptracegrpc.New(
 		context.Background(),
@@ -38,27 +51,143 @@ func main() {
 		panic(err)
 	}
 
-	queueClient := queue.NewInMemoryQueue()
+	// Messages are kept in memory unless a directory for a durable queue is configured.
+	queueTracer := tracing.NewTracer("queue", orderServiceExporter)
+	queueClient := queue.NewInMemoryQueue(&queue.InMemoryQueueConfig{Tracer: queueTracer})
+	if queueDir := os.Getenv("QUEUE_DIR"); queueDir != "" {
+		fileQueue, err := queue.NewFileQueue(&queue.FileQueueConfig{Dir: queueDir, Tracer: queueTracer})
+		if err != nil {
+			panic(err)
+		}
+
+		queueClient = fileQueue
+	}
+
+	// Orders, products and users are kept in memory unless the path of an SQLite database is configured.
+	var db *sql.DB
+	if sqlitePath := os.Getenv("SQLITE_PATH"); sqlitePath != "" {
+		db, err = sqldb.Open(sqlitePath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	databaseTracer := tracing.NewTracer("database", orderServiceExporter)
+
+	inventoryServiceTracer := tracing.NewTracer("inventory-service", orderServiceExporter)
+	inventoryRepository := inventory2.NewRepository()
+	if db != nil {
+		inventoryRepository, err = inventory2.NewSQLRepository(context.Background(), db, databaseTracer)
+		if err != nil {
+			panic(err)
+		}
+	}
+	inventoryService := inventory.NewService(inventoryRepository, inventoryServiceTracer)
 
 	orderServiceTracer := tracing.NewTracer("order-service", orderServiceExporter)
 	orderRepository := order.NewRepository()
-	orderService := order_service.NewService(orderRepository, orderServiceTracer, queueClient)
+	if db != nil {
+		orderRepository, err = order.NewSQLRepository(context.Background(), db, databaseTracer)
+		if err != nil {
+			panic(err)
+		}
+	}
+	orderService := order_service.NewService(orderRepository, orderServiceTracer, queueClient, inventoryService)
 
 	orderRestAPITracer := tracing.NewTracer("order-rest-api", orderServiceExporter)
 
 	userClientTracer := tracing.NewTracer("user-client", orderServiceExporter)
 
+	userServiceTracer := tracing.NewTracer("user-service", orderServiceExporter)
+	userRepository := userRepo.NewRepository()
+	if db != nil {
+		userRepository, err = userRepo.NewSQLRepository(context.Background(), db, databaseTracer)
+		if err != nil {
+			panic(err)
+		}
+	}
+	tokenSigner, err := auth.NewSigner(tokenIssuer)
+	if err != nil {
+		panic(err)
+	}
+	userService := user_service.NewService(userRepository, userServiceTracer, &user_service.Config{
+		Signer: tokenSigner,
+	})
+
+	// The admin user is provisioned with the configured password and the admin scope, e.g. to compact the
+	// outbox. The username is reserved, an existing admin user is reset to the configured password.
+	if adminPassword := os.Getenv("ADMIN_PASSWORD"); adminPassword != "" {
+		err := userService.ProvisionUser(context.Background(), "admin", adminPassword, auth.ScopeAdmin)
+		if err != nil {
+			panic(err)
+		}
+	}
 	userRestAPITracer := tracing.NewTracer("user-rest-api", orderServiceExporter)
-	userRestAPI := user_rest.NewServer(userRestAPITracer)
+	userRestAPI := user_rest.NewServer(userService, userRestAPITracer)
 
-	inventoryServiceTracer := tracing.NewTracer("inventory-service", orderServiceExporter)
-	inventoryRepository := inventory2.NewRepository()
-	inventoryService := inventory.NewService(inventoryRepository, inventoryServiceTracer)
+	inventoryRestAPITracer := tracing.NewTracer("inventory-rest-api", orderServiceExporter)
+	inventoryRestAPI := inventory_rest.NewServer(inventoryService, inventoryRestAPITracer)
 	deductItemTracer := tracing.NewTracer("deduct-item-handler", orderServiceExporter)
-	deductItemsHandler := inventory.NewDeductItemsHandler(inventoryService, deductItemTracer)
+	deductItemsHandler := inventory.NewDeductItemsHandler(inventoryService, deductItemTracer, queueClient)
+	commitItemsTracer := tracing.NewTracer("commit-items-handler", orderServiceExporter)
+	commitItemsHandler := inventory.NewCommitItemsHandler(inventoryService, commitItemsTracer, queueClient)
+	releaseItemsTracer := tracing.NewTracer("release-items-handler", orderServiceExporter)
+	releaseItemsHandler := inventory.NewReleaseItemsHandler(inventoryService, releaseItemsTracer, queueClient)
+	inventoryReplyTracer := tracing.NewTracer("inventory-reply-handler", orderServiceExporter)
+	inventoryReplyHandler := order_service.NewInventoryReplyHandler(orderService, inventoryReplyTracer)
+
+	// Messages of different orders are processed in parallel, the messages of one order in sequence.
+	orderedConsumeOptions := []queue.ConsumeOption{
+		queue.WithConcurrency(consumerWorkers),
+		queue.WithOrderingKey(queue.JSONFieldKey("orderId")),
+		queue.WithMaxInFlight(maxInFlightMessages),
+	}
+
+	// Consumers run until the queue is closed on shutdown.
+	consumerCtx := context.Background()
 
 	go func() {
-		err = queueClient.Consume(inventory.DeductItemsTopic, deductItemsHandler)
+		err := queueClient.Consume(
+			consumerCtx,
+			inventory.DeductItemsTopic,
+			deductItemsHandler,
+			orderedConsumeOptions...,
+		)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	go func() {
+		err := queueClient.Consume(
+			consumerCtx,
+			inventory.CommitItemsTopic,
+			commitItemsHandler,
+			orderedConsumeOptions...,
+		)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	go func() {
+		err := queueClient.Consume(
+			consumerCtx,
+			inventory.ReleaseItemsTopic,
+			releaseItemsHandler,
+			orderedConsumeOptions...,
+		)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	go func() {
+		err := queueClient.Consume(
+			consumerCtx,
+			inventory.InventoryReplyTopic,
+			inventoryReplyHandler,
+			orderedConsumeOptions...,
+		)
 		if err != nil {
 			panic(err)
 		}
@@ -73,7 +202,13 @@ func main() {
 	)
 
 	go func() {
-		err = queueClient.Consume(notification.SendNotificationTopic, sendNotificationHandler)
+		err := queueClient.Consume(
+			consumerCtx,
+			notification.SendNotificationTopic,
+			sendNotificationHandler,
+			queue.WithConcurrency(consumerWorkers),
+			queue.WithMaxInFlight(maxInFlightMessages),
+		)
 		if err != nil {
 			panic(err)
 		}
@@ -85,7 +220,14 @@ func main() {
 		}
 	}()
 
+	go func() {
+		if err := inventoryRestAPI.ListenAndServe(8082); err != nil {
+			log.Println(err)
+		}
+	}()
+
 	diagnosticsServer := diagnostics.NewServer(9000)
+	diagnosticsServer.Handle(queue.DebugPathPrefix, queue.NewDebugHandler(queueClient))
 	go func() {
 		if err := diagnosticsServer.Start(); err != nil {
 			log.Println(err)
@@ -94,11 +236,14 @@ func main() {
 
 	userClient := user.NewClient(&user.Config{
 		Address:    "http://localhost:8081",
-		HTTPClient: &http.Client{},
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
 		Tracer:     userClientTracer,
 	})
 
-	orderRestAPIServer := order_rest.NewServer(orderService, orderRestAPITracer, userClient)
+	// Bearer tokens are validated locally with the cached keys of the user service.
+	tokenVerifier := auth.NewVerifier(auth.NewCachedKeySet(userClient, nil), tokenIssuer)
+
+	orderRestAPIServer := order_rest.NewServer(orderService, orderRestAPITracer, userClient, tokenVerifier)
 	go func() {
 		err := orderRestAPIServer.ListenAndServe(8080)
 		if err != nil {
@@ -113,23 +258,44 @@ func main() {
 	log.Println("Shutting down servers...", sig)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	err = diagnosticsServer.Shutdown(ctx)
+	defer cancel()
+
+	// Stop accepting requests first, then publish the remaining outbox messages and let the consumers
+	// finish their in-flight messages before the queue is closed.
+	err = orderRestAPIServer.Shutdown(ctx)
 	if err != nil {
 		log.Println(err)
 	}
 
-	err = orderRestAPIServer.Shutdown(ctx)
+	err = userRestAPI.Shutdown(ctx)
 	if err != nil {
 		log.Println(err)
 	}
 
-	err = userRestAPI.Shutdown(ctx)
+	err = inventoryRestAPI.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = orderService.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = queueClient.Close(ctx)
 	if err != nil {
 		log.Println(err)
 	}
 
-	// Shutdown order service and its worker
-	orderService.Shutdown()
+	if db != nil {
+		err = db.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}
 
-	cancel()
+	err = diagnosticsServer.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// DebugPathPrefix is the path the handler of NewDebugHandler expects to be mounted at.
+const DebugPathPrefix = "/debug/queue/"
+
+// deadLetterResp renders the message as text, which is more readable than base64 for JSON messages.
+type deadLetterResp struct {
+	ID        string            `json:"id"`
+	Topic     string            `json:"topic"`
+	Group     string            `json:"group"`
+	Message   string            `json:"message"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Attempts  int               `json:"attempts"`
+	LastError string            `json:"lastError"`
+	FailedAt  time.Time         `json:"failedAt"`
+}
+
+type errorMessageResp struct {
+	Message string `json:"message"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewDebugHandler creates a handler to inspect the topics of a queue and to replay or purge
+// dead-lettered messages:
+//
+//	GET    /debug/queue/topics
+//	GET    /debug/queue/topics/{topic}/dead-letters
+//	POST   /debug/queue/topics/{topic}/dead-letters/{id}/replay
+//	DELETE /debug/queue/topics/{topic}/dead-letters/{id}
+func NewDebugHandler(q Queue) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /debug/queue/topics", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := q.Stats()
+		if err != nil {
+			writeDebugError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	mux.HandleFunc("GET /debug/queue/topics/{topic}/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+		deadLetters, err := q.DeadLetters(r.PathValue("topic"))
+		if err != nil {
+			writeDebugError(w, err)
+			return
+		}
+
+		resp := make([]deadLetterResp, 0, len(deadLetters))
+		for _, deadLetter := range deadLetters {
+			resp = append(resp, deadLetterResp{
+				ID:        deadLetter.ID,
+				Topic:     deadLetter.Topic,
+				Group:     deadLetter.Group,
+				Message:   string(deadLetter.Message),
+				Headers:   deadLetter.Headers,
+				Attempts:  deadLetter.Attempts,
+				LastError: deadLetter.LastError,
+				FailedAt:  deadLetter.FailedAt,
+			})
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc(
+		"POST /debug/queue/topics/{topic}/dead-letters/{id}/replay",
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := q.Redrive(r.PathValue("topic"), r.PathValue("id")); err != nil {
+				writeDebugError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)
+
+	mux.HandleFunc(
+		"DELETE /debug/queue/topics/{topic}/dead-letters/{id}",
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := q.PurgeDeadLetter(r.PathValue("topic"), r.PathValue("id")); err != nil {
+				writeDebugError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		},
+	)
+
+	return mux
+}
+
+func writeDebugError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		writeJSON(w, http.StatusNotFound, errorMessageResp{Message: "dead letter not found"})
+		return
+	}
+
+	writeJSON(w, http.StatusInternalServerError, errorMessageResp{
+		Message: "internal server error",
+		Error:   err.Error(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
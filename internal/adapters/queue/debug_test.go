@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugHandler_DeadLetters(t *testing.T) {
+	t.Parallel()
+
+	q := NewInMemoryQueue(&InMemoryQueueConfig{
+		RetryPolicy: RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Millisecond},
+	})
+	handler := NewDebugHandler(q)
+
+	go func() {
+		_ = q.Consume(context.Background(), "orders", func(context.Context, []byte) error {
+			return errors.New("handler failed")
+		}, WithGroup("billing"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, message := range []string{`{"orderId":"o1"}`, `{"orderId":"o2"}`} {
+		if err := q.Publish(context.Background(), "orders", []byte(message)); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+	waitForDeadLetters(t, q, "orders", 2)
+
+	rec := serveDebug(handler, http.MethodGet, "/debug/queue/topics/orders/dead-letters")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list: expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	var deadLetters []deadLetterResp
+	if err := json.NewDecoder(rec.Body).Decode(&deadLetters); err != nil {
+		t.Fatalf("failed to decode dead letters: %v", err)
+	}
+	if len(deadLetters) != 2 {
+		t.Fatalf("expected 2 dead letters, got %d", len(deadLetters))
+	}
+	first := deadLetters[0]
+	if first.Topic != "orders" || first.Group != "billing" || first.Message != `{"orderId":"o1"}` ||
+		first.Attempts != 1 || first.LastError != "handler failed" {
+		t.Fatalf("unexpected dead letter %+v", first)
+	}
+
+	paths := map[string]string{
+		http.MethodPost:   "/debug/queue/topics/orders/dead-letters/" + first.ID + "/replay",
+		http.MethodDelete: "/debug/queue/topics/orders/dead-letters/" + deadLetters[1].ID,
+	}
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		if rec := serveDebug(handler, method, paths[method]); rec.Code != http.StatusNoContent {
+			t.Fatalf("%s %s: expected status %d, got %d", method, paths[method], http.StatusNoContent, rec.Code)
+		}
+	}
+
+	// The replayed message fails again in its group, the purged one is gone.
+	replayed := waitForDeadLetters(t, q, "orders", 1)
+	if replayed[0].Group != "billing" || string(replayed[0].Message) != `{"orderId":"o1"}` {
+		t.Fatalf("expected the replayed message to fail in its group again, got %+v", replayed[0])
+	}
+
+	for method, path := range paths {
+		rec := serveDebug(handler, method, path)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected status %d for an unknown dead letter, got %d", method, path, http.StatusNotFound, rec.Code)
+		}
+	}
+}
+
+func serveDebug(handler http.Handler, method string, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+
+	return rec
+}
@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+)
+
+// delivery is a message handed out to a worker together with its offset in the topic.
+type delivery struct {
+	envelope *Envelope
+	offset   int64
+}
+
+// dispatch fetches messages with next and passes them to process on options.concurrency workers. If
+// an ordering key is configured, messages with the same key always go to the same worker, so they are
+// processed sequentially in publish order. dispatch returns the error of next after all workers are
+// done.
+func dispatch(options consumeOptions, next func() (*delivery, error), process func(*delivery)) error {
+	workers := make([]chan *delivery, options.concurrency)
+	var wg sync.WaitGroup
+
+	shared := make(chan *delivery)
+	for i := range workers {
+		workers[i] = shared
+		if options.orderingKey != nil {
+			workers[i] = make(chan *delivery)
+		}
+
+		wg.Add(1)
+		go func(deliveries <-chan *delivery) {
+			defer wg.Done()
+			for d := range deliveries {
+				process(d)
+			}
+		}(workers[i])
+	}
+
+	defer func() {
+		if options.orderingKey == nil {
+			close(shared)
+		} else {
+			for _, worker := range workers {
+				close(worker)
+			}
+		}
+		wg.Wait()
+	}()
+
+	for {
+		d, err := next()
+		if err != nil {
+			return err
+		}
+
+		worker := workers[0]
+		if options.orderingKey != nil {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(options.orderingKey(d.envelope.Body)))
+			worker = workers[h.Sum32()%uint32(len(workers))]
+		}
+
+		worker <- d
+	}
+}
+
+// JSONFieldKey returns an ordering key function that uses a top-level string field of JSON messages,
+// e.g. JSONFieldKey("orderId") to process the messages of one order sequentially.
+func JSONFieldKey(field string) func(message []byte) string {
+	return func(message []byte) string {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(message, &fields); err != nil {
+			return ""
+		}
+
+		var key string
+		if err := json.Unmarshal(fields[field], &key); err != nil {
+			return ""
+		}
+
+		return key
+	}
+}
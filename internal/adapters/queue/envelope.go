@@ -0,0 +1,122 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"go-microservices-observability/pkg/tracing"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.27.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Envelope wraps every published message. Its headers carry the W3C traceparent, tracestate and baggage
+// of the publisher, so the trace continues in the consumer.
+type Envelope struct {
+	ID          string            `json:"id"`
+	PublishedAt time.Time         `json:"publishedAt"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body"`
+}
+
+type envelopeKey struct{}
+
+// EnvelopeFromContext returns the envelope of the message a handler is called with.
+func EnvelopeFromContext(ctx context.Context) (*Envelope, bool) {
+	envelope, ok := ctx.Value(envelopeKey{}).(*Envelope)
+	return envelope, ok
+}
+
+// messageTracer creates the producer and consumer spans of a queue following the OpenTelemetry messaging
+// semantic conventions. Without a tracer, the trace context of the publisher is still propagated.
+type messageTracer struct {
+	tracer tracing.Tracer
+	system string
+}
+
+func (t messageTracer) start(
+	ctx context.Context,
+	spanName string,
+	opts ...oteltrace.SpanStartOption,
+) (context.Context, oteltrace.Span) {
+	if t.tracer == nil {
+		return noop.NewTracerProvider().Tracer("").Start(ctx, spanName)
+	}
+
+	return t.tracer.Start(ctx, spanName, opts...)
+}
+
+// publish wraps the message in an envelope with the trace context of a producer span. The span has to be
+// ended by the caller once the message is stored.
+func (t messageTracer) publish(ctx context.Context, topic string, body []byte) (*Envelope, oteltrace.Span) {
+	envelope := &Envelope{
+		ID:          uuid.New().String(),
+		PublishedAt: time.Now(),
+		Headers:     make(map[string]string),
+		Body:        body,
+	}
+
+	ctx, span := t.start(
+		ctx,
+		"publish "+topic,
+		oteltrace.WithSpanKind(oteltrace.SpanKindProducer),
+		oteltrace.WithAttributes(t.attributes(topic, envelope)...),
+		oteltrace.WithAttributes(
+			semconv.MessagingOperationName("publish"),
+			semconv.MessagingOperationTypePublish,
+		),
+	)
+	tracing.InjectMessage(ctx, envelope.Headers)
+
+	return envelope, span
+}
+
+// process passes the message to the handler within a consumer span, which is a child of the span the
+// message was published in.
+func (t messageTracer) process(
+	ctx context.Context,
+	topic string,
+	group string,
+	envelope *Envelope,
+	handler Handler,
+) error {
+	ctx = tracing.ExtractMessage(ctx, envelope.Headers)
+	ctx, span := t.start(
+		ctx,
+		"process "+topic,
+		oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+		oteltrace.WithAttributes(t.attributes(topic, envelope)...),
+		oteltrace.WithAttributes(
+			semconv.MessagingOperationName("process"),
+			semconv.MessagingOperationTypeProcess,
+			semconv.MessagingConsumerGroupName(group),
+		),
+	)
+	defer span.End()
+
+	err := handler(context.WithValue(ctx, envelopeKey{}, envelope), envelope.Body)
+	recordError(span, err)
+
+	return err
+}
+
+func (t messageTracer) attributes(topic string, envelope *Envelope) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingSystemKey.String(t.system),
+		semconv.MessagingDestinationName(topic),
+		semconv.MessagingMessageID(envelope.ID),
+		semconv.MessagingMessageBodySize(len(envelope.Body)),
+	}
+}
+
+// recordError marks the span as failed if the operation returned an error.
+func recordError(span oteltrace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,878 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-microservices-observability/internal/errs"
+	"go-microservices-observability/pkg/tracing"
+)
+
+const (
+	segmentExtension       = ".log"
+	offsetExtension        = ".offset"
+	recordHeaderSize       = 8
+	defaultMaxSegmentBytes = 16 * 1024 * 1024
+)
+
+var ErrConsumerExists = errs.New(errs.ErrAlreadyExists, "consumer group already has a consumer")
+
+// FileQueueConfig configures a FileQueue.
+type FileQueueConfig struct {
+	// Dir is the directory the topics are stored in. Every topic gets its own subdirectory.
+	Dir string
+	// MaxSegmentBytes is the size after which a new segment is started. Defaults to 16 MiB.
+	MaxSegmentBytes int64
+	// SyncWrites fsyncs every published message before Publish returns.
+	SyncWrites bool
+	// RetryPolicy defines the redelivery of rejected messages. Defaults to DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+	// Tracer creates the publish and process spans of the messages. Optional.
+	Tracer tracing.Tracer
+}
+
+// FileQueue is a durable implementation of the Queue interface. Every topic is an append-only log
+// split into segment files, each named after the offset of its first message. The offset of the next
+// message to consume is persisted per consumer group, so consumption continues where it stopped after
+// a restart.
+type FileQueue struct {
+	config *FileQueueConfig
+	tracer messageTracer
+	topics map[string]*fileTopic
+	mu     sync.Mutex
+	// closing is cancelled by Close to stop the consumers, consumers tracks the running ones.
+	closing   context.Context
+	stop      context.CancelFunc
+	consumers sync.WaitGroup
+	closed    bool
+}
+
+// NewFileQueue creates a new FileQueue storing its topics in config.Dir.
+func NewFileQueue(config *FileQueueConfig) (*FileQueue, error) {
+	if config.MaxSegmentBytes <= 0 {
+		config.MaxSegmentBytes = defaultMaxSegmentBytes
+	}
+	config.RetryPolicy = config.RetryPolicy.WithDefaults(DefaultRetryPolicy)
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	closing, stop := context.WithCancel(context.Background())
+
+	return &FileQueue{
+		config:  config,
+		tracer:  messageTracer{tracer: config.Tracer, system: "file"},
+		topics:  make(map[string]*fileTopic),
+		closing: closing,
+		stop:    stop,
+	}, nil
+}
+
+// Publish appends a message to the log of a topic. The topic is created if it doesn't exist yet.
+func (q *FileQueue) Publish(ctx context.Context, topic string, message interface{}) error {
+	messageBytes, err := encodeMessage(message)
+	if err != nil {
+		return err
+	}
+
+	envelope, span := q.tracer.publish(ctx, topic, messageBytes)
+	defer span.End()
+
+	err = q.publish(ctx, topic, &logRecord{Envelope: envelope})
+	recordError(span, err)
+
+	return err
+}
+
+func (q *FileQueue) publish(ctx context.Context, topic string, record *logRecord) error {
+	message, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+
+	t, err := q.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	return t.append(ctx, message, q.closing.Done())
+}
+
+// Consume consumes messages of a topic starting at the persisted offset of the consumer group and passes
+// them to the handler. The offset only advances over messages that are acknowledged or dead-lettered,
+// so with several workers a message finished early is only committed once all messages before it are.
+// A consumer group can only have one consumer at a time.
+func (q *FileQueue) Consume(ctx context.Context, topic string, handler Handler, opts ...ConsumeOption) error {
+	options := newConsumeOptions(opts)
+
+	q.mu.Lock()
+	if q.closing.Err() != nil {
+		q.mu.Unlock()
+		return ErrQueueClosed
+	}
+	q.consumers.Add(1)
+	defer q.consumers.Done()
+	q.mu.Unlock()
+
+	t, err := q.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	if t.consumers[options.group] {
+		t.mu.Unlock()
+		return fmt.Errorf("%w: %s/%s", ErrConsumerExists, topic, options.group)
+	}
+	t.consumers[options.group] = true
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		// Without a consumer the offset of the group doesn't advance, so its limit would block appends for
+		// good.
+		delete(t.consumers, options.group)
+		delete(t.committed, options.group)
+		delete(t.maxInFlight, options.group)
+		close(t.released)
+		t.released = make(chan struct{})
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(q.closing, cancel)()
+
+	offset, err := t.loadOffset(options.group)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.committed[options.group] = offset
+	if options.maxInFlight > 0 {
+		t.maxInFlight[options.group] = int64(options.maxInFlight)
+	}
+	t.mu.Unlock()
+
+	r := t.newReader(offset)
+	defer r.close()
+
+	tracker := &offsetTracker{next: offset, acked: make(map[int64]bool)}
+
+	next := func() (*delivery, error) {
+		for {
+			record, err := r.next(ctx.Done())
+			if err != nil {
+				return nil, err
+			}
+
+			offset := r.offset - 1
+			if record.Group == "" || record.Group == options.group {
+				return &delivery{envelope: record.Envelope, offset: offset}, nil
+			}
+
+			// The message was redriven to another group, skip over it.
+			if err := t.ack(options.group, tracker, offset); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = dispatch(options, next, func(d *delivery) {
+		attempts, err := deliver(ctx, func() error {
+			// The handler finishes an in-flight message even if the consumer is stopped meanwhile.
+			return q.tracer.process(context.WithoutCancel(ctx), topic, options.group, d.envelope, handler)
+		}, q.config.RetryPolicy)
+		if errors.Is(err, errConsumerStopped) {
+			// The message isn't acknowledged, so it is delivered again to the next consumer of the group.
+			return
+		}
+		if err != nil {
+			fmt.Printf("Moving message to %s after %d attempts\n", DeadLetterTopic(topic), attempts)
+			err := q.Publish(context.WithoutCancel(ctx), DeadLetterTopic(topic), deadLetterRecord{
+				DeadLetter: newDeadLetter(topic, options.group, d.envelope, attempts, err),
+			})
+			if err != nil {
+				fmt.Printf("Error dead-lettering message at offset %d: %v\n", d.offset, err)
+				return
+			}
+		}
+
+		if err := t.ack(options.group, tracker, d.offset); err != nil {
+			fmt.Printf("Error acknowledging message at offset %d: %v\n", d.offset, err)
+		}
+	})
+	if errors.Is(err, errConsumerStopped) {
+		return nil
+	}
+
+	return err
+}
+
+// Replay passes the messages of a topic from the given offset up to the current end of the log to the
+// handler. The persisted consumer offset is left untouched, which makes it safe to use for debugging.
+// No consumer spans are created for replayed messages.
+func (q *FileQueue) Replay(topic string, fromOffset int64, handler Handler) error {
+	t, err := q.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	end := t.nextOffset
+	t.mu.Unlock()
+
+	r := t.newReader(fromOffset)
+	defer r.close()
+
+	for r.offset < end {
+		record, err := r.next(q.closing.Done())
+		if errors.Is(err, errConsumerStopped) {
+			return ErrQueueClosed
+		}
+		if err != nil {
+			return err
+		}
+
+		ctx := tracing.ExtractMessage(context.Background(), record.Headers)
+		if err := handler(context.WithValue(ctx, envelopeKey{}, record.Envelope), record.Body); err != nil {
+			return fmt.Errorf("failed to replay message at offset %d: %w", r.offset-1, err)
+		}
+	}
+
+	return nil
+}
+
+// DeadLetters returns the dead-lettered messages of a topic, oldest first. They are read from the log of
+// the dead-letter topic, skipping messages that have been redriven since.
+func (q *FileQueue) DeadLetters(topic string) ([]*DeadLetter, error) {
+	var deadLetters []*DeadLetter
+	removed := make(map[string]bool)
+
+	err := q.Replay(DeadLetterTopic(topic), 0, func(_ context.Context, message []byte) error {
+		var record deadLetterRecord
+		if err := json.Unmarshal(message, &record); err != nil {
+			return fmt.Errorf("failed to unmarshal dead letter: %w", err)
+		}
+
+		if record.Tombstone {
+			removed[record.ID] = true
+		} else {
+			deadLetters = append(deadLetters, record.DeadLetter)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*DeadLetter, 0, len(deadLetters))
+	for _, deadLetter := range deadLetters {
+		if !removed[deadLetter.ID] {
+			result = append(result, deadLetter)
+		}
+	}
+
+	return result, nil
+}
+
+// Redrive appends a dead-lettered message to the log of its topic again, keeping the headers it was
+// published with. The message is restricted to the consumer group it failed in, the other groups skip
+// over it. The dead letter is removed by appending a tombstone for it, as the log is append-only.
+func (q *FileQueue) Redrive(topic string, id string) error {
+	deadLetter, err := q.findDeadLetter(topic, id)
+	if err != nil {
+		return err
+	}
+
+	record := &logRecord{Envelope: deadLetter.envelope(), Group: deadLetter.Group}
+	if err := q.publish(context.Background(), topic, record); err != nil {
+		return err
+	}
+
+	return q.removeDeadLetter(topic, id)
+}
+
+// PurgeDeadLetter drops a dead-lettered message for good.
+func (q *FileQueue) PurgeDeadLetter(topic string, id string) error {
+	if _, err := q.findDeadLetter(topic, id); err != nil {
+		return err
+	}
+
+	return q.removeDeadLetter(topic, id)
+}
+
+// Stats returns the state of every topic stored in the queue directory.
+func (q *FileQueue) Stats() ([]TopicStats, error) {
+	entries, err := os.ReadDir(q.config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topics: %w", err)
+	}
+
+	var stats []TopicStats
+	for _, entry := range entries {
+		name, err := url.PathUnescape(entry.Name())
+		if !entry.IsDir() || err != nil || strings.HasSuffix(name, deadLetterSuffix) {
+			continue
+		}
+
+		t, err := q.topic(name)
+		if err != nil {
+			return nil, err
+		}
+
+		pending, err := t.pending()
+		if err != nil {
+			return nil, err
+		}
+
+		deadLetters, err := q.DeadLetters(name)
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, TopicStats{
+			Topic:       name,
+			Pending:     pending,
+			DeadLetters: len(deadLetters),
+		})
+	}
+
+	return stats, nil
+}
+
+// Close stops the consumers, waits for their in-flight messages and closes the segment files.
+func (q *FileQueue) Close(ctx context.Context) error {
+	// Consume registers itself under the lock, so no consumer is added once Wait is called.
+	q.mu.Lock()
+	q.stop()
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.consumers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+
+	var errs []error
+	for _, t := range q.topics {
+		t.mu.Lock()
+		errs = append(errs, t.active.Close())
+		t.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+func (q *FileQueue) topic(name string) (*fileTopic, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	if t, ok := q.topics[name]; ok {
+		return t, nil
+	}
+
+	t, err := openFileTopic(filepath.Join(q.config.Dir, url.PathEscape(name)), q.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open topic %s: %w", name, err)
+	}
+	q.topics[name] = t
+
+	return t, nil
+}
+
+func (q *FileQueue) findDeadLetter(topic string, id string) (*DeadLetter, error) {
+	deadLetters, err := q.DeadLetters(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, deadLetter := range deadLetters {
+		if deadLetter.ID == id {
+			return deadLetter, nil
+		}
+	}
+
+	return nil, ErrDeadLetterNotFound
+}
+
+func (q *FileQueue) removeDeadLetter(topic string, id string) error {
+	return q.Publish(context.Background(), DeadLetterTopic(topic), deadLetterRecord{
+		DeadLetter: &DeadLetter{ID: id, Topic: topic},
+		Tombstone:  true,
+	})
+}
+
+// logRecord is a message in the log of a topic.
+type logRecord struct {
+	*Envelope
+	// Group restricts the message to a single consumer group, e.g. for redriven messages.
+	Group string `json:"group,omitempty"`
+}
+
+// deadLetterRecord is the log record of a dead-letter topic. A tombstone removes the dead letter with
+// the same ID.
+type deadLetterRecord struct {
+	*DeadLetter
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+// fileTopic is the segmented log of a single topic.
+type fileTopic struct {
+	dir    string
+	config *FileQueueConfig
+
+	mu         sync.Mutex
+	segments   []int64
+	active     *os.File
+	activeSize int64
+	nextOffset int64
+	consumers  map[string]bool
+	// committed and maxInFlight are tracked per consumer group to apply backpressure on append.
+	committed   map[string]int64
+	maxInFlight map[string]int64
+	// released is closed and replaced whenever a committed offset advances to wake up blocked appends.
+	released chan struct{}
+	// appended is closed and replaced on every append to wake up waiting readers.
+	appended chan struct{}
+}
+
+func openFileTopic(dir string, config *FileQueueConfig) (*fileTopic, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &fileTopic{
+		dir:         dir,
+		config:      config,
+		segments:    segments,
+		consumers:   make(map[string]bool),
+		committed:   make(map[string]int64),
+		maxInFlight: make(map[string]int64),
+		appended:    make(chan struct{}),
+		released:    make(chan struct{}),
+	}
+
+	if len(segments) == 0 {
+		t.segments = []int64{0}
+	}
+
+	lastBase := t.segments[len(t.segments)-1]
+	count, size, err := recoverSegment(t.segmentPath(lastBase))
+	if err != nil {
+		return nil, err
+	}
+
+	t.active, err = os.OpenFile(t.segmentPath(lastBase), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	t.activeSize = size
+	t.nextOffset = lastBase + count
+
+	return t, nil
+}
+
+func (t *fileTopic) append(ctx context.Context, message []byte, closing <-chan struct{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Apply backpressure until every consumer group with an in-flight limit is below it.
+	for t.full() {
+		released := t.released
+		t.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			t.mu.Lock()
+			return ctx.Err()
+		case <-closing:
+			t.mu.Lock()
+			return ErrQueueClosed
+		}
+
+		t.mu.Lock()
+	}
+
+	if t.activeSize > 0 && t.activeSize+int64(recordHeaderSize+len(message)) > t.config.MaxSegmentBytes {
+		if err := t.roll(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, recordHeaderSize+len(message))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(message)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(message))
+	copy(record[recordHeaderSize:], message)
+
+	if _, err := t.active.Write(record); err != nil {
+		return fmt.Errorf("failed to append message: %w", err)
+	}
+
+	if t.config.SyncWrites {
+		if err := t.active.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment: %w", err)
+		}
+	}
+
+	t.activeSize += int64(len(record))
+	t.nextOffset++
+	close(t.appended)
+	t.appended = make(chan struct{})
+
+	return nil
+}
+
+// full reports whether a consumer group reached its in-flight limit. It must be called with t.mu held.
+func (t *fileTopic) full() bool {
+	for group, limit := range t.maxInFlight {
+		if t.nextOffset-t.committed[group] >= limit {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ack marks the message at offset as finished and persists the offset of the group once all messages
+// before it are finished as well.
+func (t *fileTopic) ack(group string, tracker *offsetTracker, offset int64) error {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.acked[offset] = true
+	committed := tracker.next
+	for tracker.acked[tracker.next] {
+		delete(tracker.acked, tracker.next)
+		tracker.next++
+	}
+
+	if tracker.next == committed {
+		return nil
+	}
+
+	if err := t.storeOffset(group, tracker.next); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.committed[group] = tracker.next
+	close(t.released)
+	t.released = make(chan struct{})
+	t.mu.Unlock()
+
+	return nil
+}
+
+// offsetTracker collects the acknowledged offsets of a consumer that are not contiguous yet.
+type offsetTracker struct {
+	mu    sync.Mutex
+	next  int64
+	acked map[int64]bool
+}
+
+func (t *fileTopic) roll() error {
+	if err := t.active.Close(); err != nil {
+		return err
+	}
+
+	active, err := os.OpenFile(t.segmentPath(t.nextOffset), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+
+	t.active = active
+	t.activeSize = 0
+	t.segments = append(t.segments, t.nextOffset)
+
+	return nil
+}
+
+func (t *fileTopic) segmentPath(base int64) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%020d%s", base, segmentExtension))
+}
+
+func (t *fileTopic) loadOffset(group string) (int64, error) {
+	b, err := os.ReadFile(t.offsetPath(group))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read consumer offset: %w", err)
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid consumer offset: %w", err)
+	}
+
+	return offset, nil
+}
+
+// storeOffset persists the offset by replacing the offset file, so that a crash never leaves a torn file.
+func (t *fileTopic) storeOffset(group string, offset int64) error {
+	tmp := t.offsetPath(group) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0o644); err != nil {
+		return fmt.Errorf("failed to write consumer offset: %w", err)
+	}
+
+	if err := os.Rename(tmp, t.offsetPath(group)); err != nil {
+		return fmt.Errorf("failed to replace consumer offset: %w", err)
+	}
+
+	return nil
+}
+
+func (t *fileTopic) offsetPath(group string) string {
+	return filepath.Join(t.dir, url.PathEscape(group)+offsetExtension)
+}
+
+// pending returns the number of messages behind the offset of the consumer group furthest behind.
+func (t *fileTopic) pending() (int64, error) {
+	t.mu.Lock()
+	next := t.nextOffset
+	t.mu.Unlock()
+
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var pending int64
+	groups := 0
+	for _, entry := range entries {
+		group, ok := strings.CutSuffix(entry.Name(), offsetExtension)
+		if !ok {
+			continue
+		}
+
+		group, err = url.PathUnescape(group)
+		if err != nil {
+			continue
+		}
+
+		offset, err := t.loadOffset(group)
+		if err != nil {
+			return 0, err
+		}
+
+		pending = max(pending, next-offset)
+		groups++
+	}
+
+	if groups == 0 {
+		return next, nil
+	}
+
+	return pending, nil
+}
+
+func (t *fileTopic) newReader(offset int64) *segmentReader {
+	return &segmentReader{topic: t, offset: offset}
+}
+
+// segmentReader reads the log of a topic sequentially across segments.
+type segmentReader struct {
+	topic  *fileTopic
+	offset int64
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// next returns the message at the current offset, waiting for it to be published if necessary.
+func (r *segmentReader) next(done <-chan struct{}) (*logRecord, error) {
+	for {
+		r.topic.mu.Lock()
+		available := r.offset < r.topic.nextOffset
+		appended := r.topic.appended
+		r.topic.mu.Unlock()
+
+		if available {
+			break
+		}
+
+		select {
+		case <-appended:
+		case <-done:
+			return nil, errConsumerStopped
+		}
+	}
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	message, err := readRecord(r.reader)
+	if errors.Is(err, io.EOF) {
+		// The current segment is exhausted, the message is the first one of the next segment.
+		r.close()
+		if err := r.open(); err != nil {
+			return nil, err
+		}
+		message, err = readRecord(r.reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message at offset %d: %w", r.offset, err)
+	}
+
+	var record logRecord
+	if err := json.Unmarshal(message, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message at offset %d: %w", r.offset, err)
+	}
+
+	r.offset++
+
+	return &record, nil
+}
+
+// open opens the segment containing the current offset and skips to it.
+func (r *segmentReader) open() error {
+	r.topic.mu.Lock()
+	segments := r.topic.segments
+	r.topic.mu.Unlock()
+
+	i := sort.Search(len(segments), func(i int) bool { return segments[i] > r.offset }) - 1
+	if i < 0 {
+		return fmt.Errorf("offset %d is before the first segment", r.offset)
+	}
+
+	file, err := os.Open(r.topic.segmentPath(segments[i]))
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+
+	r.file = file
+	r.reader = bufio.NewReader(file)
+
+	for skip := r.offset - segments[i]; skip > 0; skip-- {
+		if _, err := readRecord(r.reader); err != nil {
+			r.close()
+			return fmt.Errorf("failed to seek to offset %d: %w", r.offset, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *segmentReader) close() {
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+		r.reader = nil
+	}
+}
+
+func readRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(message) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	return message, nil
+}
+
+// recoverSegment counts the valid records of a segment and truncates a torn record left by a crash.
+func recoverSegment(path string) (int64, int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	var count, size int64
+	for {
+		message, err := readRecord(reader)
+		if err != nil {
+			break
+		}
+
+		count++
+		size += int64(recordHeaderSize + len(message))
+	}
+
+	if err := file.Truncate(size); err != nil {
+		return 0, 0, fmt.Errorf("failed to truncate segment: %w", err)
+	}
+
+	return count, size, nil
+}
+
+func listSegments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, base)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	return segments, nil
+}
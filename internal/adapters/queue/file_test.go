@@ -0,0 +1,287 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileQueue_ConsumeContinuesAfterRestart(t *testing.T) {
+	t.Parallel()
+
+	config := &FileQueueConfig{Dir: t.TempDir(), MaxSegmentBytes: 64}
+
+	q := newTestFileQueue(t, config)
+	publishN(t, q, "orders", 0, 4)
+	received, finished := consumeN(t, q, "orders", 4)
+	closeFileQueue(t, q)
+	<-finished
+
+	if fmt.Sprint(received) != "[0 1 2 3]" {
+		t.Errorf("unexpected messages %v", received)
+	}
+
+	q = newTestFileQueue(t, config)
+	defer closeFileQueue(t, q)
+
+	publishN(t, q, "orders", 4, 10)
+	received, _ = consumeN(t, q, "orders", 6)
+
+	if fmt.Sprint(received) != "[4 5 6 7 8 9]" {
+		t.Errorf("consumer did not continue at the persisted offset: %v", received)
+	}
+}
+
+func TestFileQueue_Replay(t *testing.T) {
+	t.Parallel()
+
+	q := newTestFileQueue(t, &FileQueueConfig{Dir: t.TempDir(), MaxSegmentBytes: 32})
+	defer closeFileQueue(t, q)
+
+	publishN(t, q, "orders", 0, 5)
+
+	var replayed []string
+	err := q.Replay("orders", 2, func(_ context.Context, message []byte) error {
+		replayed = append(replayed, string(message))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+
+	if fmt.Sprint(replayed) != "[2 3 4]" {
+		t.Errorf("unexpected replayed messages %v", replayed)
+	}
+}
+
+func TestFileQueue_DeadLetterAndRedrive(t *testing.T) {
+	t.Parallel()
+
+	q := newTestFileQueue(t, &FileQueueConfig{
+		Dir:         t.TempDir(),
+		RetryPolicy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+	defer closeFileQueue(t, q)
+
+	var mu sync.Mutex
+	attempts := 0
+	fail := true
+	go func() {
+		_ = q.Consume(context.Background(), "orders", func(_ context.Context, message []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if fail {
+				return errors.New("handler failed")
+			}
+			return nil
+		})
+	}()
+
+	publishN(t, q, "orders", 0, 1)
+
+	deadLetters := waitForDeadLetters(t, q, "orders", 1)
+	if deadLetters[0].Attempts != 3 || deadLetters[0].LastError != "handler failed" {
+		t.Errorf("unexpected dead letter %+v", deadLetters[0])
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	if err := q.Redrive("orders", deadLetters[0].ID); err != nil {
+		t.Fatalf("failed to redrive: %v", err)
+	}
+	waitForDeadLetters(t, q, "orders", 0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := attempts == 4
+		mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("redriven message was not delivered")
+}
+
+func TestFileQueue_RedriveOnlyToFailedGroup(t *testing.T) {
+	t.Parallel()
+
+	q := newTestFileQueue(t, &FileQueueConfig{
+		Dir:         t.TempDir(),
+		RetryPolicy: RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Millisecond},
+	})
+	defer closeFileQueue(t, q)
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	fail := true
+	for _, group := range []string{"billing", "shipping"} {
+		go func() {
+			_ = q.Consume(context.Background(), "orders", func(_ context.Context, message []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received[group] = append(received[group], string(message))
+				if group == "billing" && fail {
+					return errors.New("handler failed")
+				}
+				return nil
+			}, WithGroup(group))
+		}()
+	}
+
+	publishN(t, q, "orders", 0, 1)
+
+	deadLetters := waitForDeadLetters(t, q, "orders", 1)
+	if deadLetters[0].Group != "billing" {
+		t.Fatalf("unexpected dead letter group %q", deadLetters[0].Group)
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	if err := q.Redrive("orders", deadLetters[0].ID); err != nil {
+		t.Fatalf("failed to redrive: %v", err)
+	}
+	publishN(t, q, "orders", 1, 2)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(received["billing"]) == 3 && len(received["shipping"]) == 2
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(received["billing"]) != "[0 0 1]" {
+		t.Errorf("unexpected messages of the failed group %v", received["billing"])
+	}
+	if fmt.Sprint(received["shipping"]) != "[0 1]" {
+		t.Errorf("redriven message was delivered to another group: %v", received["shipping"])
+	}
+}
+
+func TestFileQueue_PublishAfterConsumerStopped(t *testing.T) {
+	t.Parallel()
+
+	q := newTestFileQueue(t, &FileQueueConfig{Dir: t.TempDir()})
+	defer closeFileQueue(t, q)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		_ = q.Consume(ctx, "orders", func(context.Context, []byte) error {
+			return nil
+		}, WithMaxInFlight(1))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-stopped
+
+	publishCtx, cancelPublish := context.WithTimeout(context.Background(), time.Second)
+	defer cancelPublish()
+	for i := 0; i < 3; i++ {
+		if err := q.Publish(publishCtx, "orders", []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("publish %d blocked after the consumer stopped: %v", i, err)
+		}
+	}
+}
+
+func waitForDeadLetters(t *testing.T, q Queue, topic string, n int) []*DeadLetter {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deadLetters, err := q.DeadLetters(topic)
+		if err != nil {
+			t.Fatalf("failed to get dead letters: %v", err)
+		}
+		if len(deadLetters) == n {
+			return deadLetters
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d dead letters, want %d", len(deadLetters), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestFileQueue(t *testing.T, config *FileQueueConfig) *FileQueue {
+	t.Helper()
+
+	q, err := NewFileQueue(config)
+	if err != nil {
+		t.Fatalf("failed to create file queue: %v", err)
+	}
+
+	return q
+}
+
+func closeFileQueue(t *testing.T, q *FileQueue) {
+	t.Helper()
+
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatalf("failed to close file queue: %v", err)
+	}
+}
+
+func publishN(t *testing.T, q *FileQueue, topic string, from int, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if err := q.Publish(context.Background(), topic, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+}
+
+// consumeN starts a consumer and waits until it has received n messages. The returned channel is
+// closed once the consumer has stopped.
+func consumeN(t *testing.T, q *FileQueue, topic string, n int) ([]string, <-chan struct{}) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var received []string
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		_ = q.Consume(context.Background(), topic, func(_ context.Context, message []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, string(message))
+			return nil
+		})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(received) >= n
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) < n {
+		t.Fatalf("received %d messages, want %d", len(received), n)
+	}
+
+	return append([]string(nil), received...), finished
+}
@@ -1,67 +1,418 @@
 package queue
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
+
+	"go-microservices-observability/pkg/tracing"
 )
 
-// InMemoryQueue is an in-memory implementation of the Queue interface.
+// InMemoryQueueConfig configures an InMemoryQueue.
+type InMemoryQueueConfig struct {
+	RetryPolicy RetryPolicy
+	// Tracer creates the publish and process spans of the messages. Optional.
+	Tracer tracing.Tracer
+}
+
+// InMemoryQueue is an in-memory implementation of the Queue interface. Every topic is a log with an
+// offset per consumer group. Messages are retained until every group has received them.
 type InMemoryQueue struct {
-	messages map[string]chan []byte
-	mu       sync.RWMutex
+	topics      map[string]*memoryTopic
+	deadLetters map[string][]*DeadLetter
+	retryPolicy RetryPolicy
+	tracer      messageTracer
+	mu          sync.RWMutex
+	// closing is cancelled by Close to stop the consumers, consumers tracks the running ones.
+	closing   context.Context
+	stop      context.CancelFunc
+	consumers sync.WaitGroup
+	closed    bool
+}
+
+type memoryTopic struct {
+	// messages holds the retained messages, the first one is at offset base.
+	messages []memoryMessage
+	base     int64
+	groups   map[string]*memoryGroup
+	// appended is closed and replaced on every publish to wake up waiting consumers.
+	appended chan struct{}
+	// released is closed and replaced whenever a message is finished to wake up blocked publishers.
+	released chan struct{}
+}
+
+type memoryMessage struct {
+	envelope *Envelope
+	// group restricts the message to a single consumer group, e.g. for redriven messages.
+	group string
 }
 
-// NewInMemoryQueue creates a new InMemoryQueue.
-func NewInMemoryQueue() Queue {
+type memoryGroup struct {
+	// offset is the next message to hand out to a consumer of the group.
+	offset      int64
+	inFlight    int64
+	maxInFlight int64
+	consumers   int
+}
+
+// NewInMemoryQueue creates a new InMemoryQueue. A nil config uses the DefaultRetryPolicy.
+func NewInMemoryQueue(config *InMemoryQueueConfig) Queue {
+	if config == nil {
+		config = &InMemoryQueueConfig{}
+	}
+
+	closing, stop := context.WithCancel(context.Background())
+
 	return &InMemoryQueue{
-		messages: make(map[string]chan []byte),
+		topics:      make(map[string]*memoryTopic),
+		deadLetters: make(map[string][]*DeadLetter),
+		retryPolicy: config.RetryPolicy.WithDefaults(DefaultRetryPolicy),
+		tracer:      messageTracer{tracer: config.Tracer, system: "in-memory"},
+		closing:     closing,
+		stop:        stop,
 	}
 }
 
 // Publish publishes a message to the queue on a specific topic.
-func (q *InMemoryQueue) Publish(topic string, message interface{}) error {
-	var messageBytes []byte
-	var err error
-
-	switch m := message.(type) {
-	case []byte:
-		messageBytes = m
-	default:
-		messageBytes, err = json.Marshal(message)
+func (q *InMemoryQueue) Publish(ctx context.Context, topic string, message interface{}) error {
+	messageBytes, err := encodeMessage(message)
+	if err != nil {
+		return err
+	}
+
+	envelope, span := q.tracer.publish(ctx, topic, messageBytes)
+	defer span.End()
+
+	err = q.publish(ctx, topic, envelope)
+	recordError(span, err)
+
+	return err
+}
+
+func (q *InMemoryQueue) publish(ctx context.Context, topic string, envelope *Envelope) error {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return ErrQueueClosed
+		}
+
+		t := q.topic(topic)
+		if !t.full() {
+			q.append(topic, memoryMessage{envelope: envelope})
+			q.mu.Unlock()
+
+			return nil
+		}
+
+		// Apply backpressure until a consumer group with an in-flight limit finished a message.
+		released := t.released
+		q.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.closing.Done():
+			return ErrQueueClosed
+		}
+	}
+}
+
+// Consume consumes messages from the queue on a specific topic and passes them to the handler. A
+// rejected message is redelivered until it is acknowledged or moved to the dead-letter topic.
+func (q *InMemoryQueue) Consume(ctx context.Context, topic string, handler Handler, opts ...ConsumeOption) error {
+	options := newConsumeOptions(opts)
+
+	q.mu.Lock()
+	if q.closing.Err() != nil {
+		q.mu.Unlock()
+		return ErrQueueClosed
+	}
+	q.consumers.Add(1)
+	defer q.consumers.Done()
+
+	t := q.topic(topic)
+	g, ok := t.groups[options.group]
+	if !ok {
+		// A new group starts with the oldest retained message.
+		g = &memoryGroup{offset: t.base}
+		t.groups[options.group] = g
+	}
+	if options.maxInFlight > 0 {
+		g.maxInFlight = int64(options.maxInFlight)
+	}
+	g.consumers++
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		// Without a consumer the offset of the group doesn't advance, so its limit would block publishers
+		// for good. The group keeps its offset and retained messages for the next consumer.
+		g.consumers--
+		if g.consumers == 0 {
+			g.maxInFlight = 0
+			close(t.released)
+			t.released = make(chan struct{})
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(q.closing, cancel)()
+
+	next := func() (*delivery, error) {
+		envelope, err := q.next(ctx, topic, options.group)
 		if err != nil {
-			return fmt.Errorf("failed to marshal message to JSON: %w", err)
+			return nil, err
+		}
+
+		return &delivery{envelope: envelope}, nil
+	}
+
+	err := dispatch(options, next, func(d *delivery) {
+		attempts, err := deliver(ctx, func() error {
+			// The handler finishes an in-flight message even if the consumer is stopped meanwhile.
+			return q.tracer.process(context.WithoutCancel(ctx), topic, options.group, d.envelope, handler)
+		}, q.retryPolicy)
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		g.inFlight--
+		switch {
+		case errors.Is(err, errConsumerStopped):
+			// Hand the message to the next consumer of the group instead of losing it.
+			q.append(topic, memoryMessage{envelope: d.envelope, group: options.group})
+		case err != nil:
+			fmt.Printf("Moving message to %s after %d attempts\n", DeadLetterTopic(topic), attempts)
+			q.deadLetters[topic] = append(
+				q.deadLetters[topic],
+				newDeadLetter(topic, options.group, d.envelope, attempts, err),
+			)
 		}
+
+		close(t.released)
+		t.released = make(chan struct{})
+	})
+	if errors.Is(err, errConsumerStopped) {
+		return nil
 	}
 
+	return err
+}
+
+// Close stops the consumers and waits for their in-flight messages. Messages that are not handed out
+// to a consumer yet are lost.
+func (q *InMemoryQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	q.stop()
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.consumers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	return nil
+}
+
+// DeadLetters returns the dead-lettered messages of a topic, oldest first.
+func (q *InMemoryQueue) DeadLetters(topic string) ([]*DeadLetter, error) {
 	q.mu.RLock()
-	topicChan, ok := q.messages[topic]
-	q.mu.RUnlock()
+	defer q.mu.RUnlock()
 
-	if !ok {
-		return fmt.Errorf("topic %s does not exist", topic)
+	return append([]*DeadLetter(nil), q.deadLetters[topic]...), nil
+}
+
+// Redrive publishes a dead-lettered message again to the consumer group it failed in and removes it
+// from the dead letters. The message keeps its headers, so it stays part of the trace it was published
+// in.
+func (q *InMemoryQueue) Redrive(topic string, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	deadLetter, err := q.removeDeadLetter(topic, id)
+	if err != nil {
+		return err
 	}
 
-	topicChan <- messageBytes
+	q.append(topic, memoryMessage{envelope: deadLetter.envelope(), group: deadLetter.Group})
+
 	return nil
 }
 
-// Consume consumes messages from the queue on a specific topic and passes them to the handler.
-func (q *InMemoryQueue) Consume(topic string, handler Handler) error {
+// PurgeDeadLetter drops a dead-lettered message for good.
+func (q *InMemoryQueue) PurgeDeadLetter(topic string, id string) error {
 	q.mu.Lock()
-	topicChan, ok := q.messages[topic]
+	defer q.mu.Unlock()
+
+	_, err := q.removeDeadLetter(topic, id)
+	return err
+}
+
+// Stats returns the state of every topic that has messages, consumers or dead letters.
+func (q *InMemoryQueue) Stats() ([]TopicStats, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	topics := make(map[string]bool)
+	for topic := range q.topics {
+		topics[topic] = true
+	}
+	for topic := range q.deadLetters {
+		topics[topic] = true
+	}
+
+	stats := make([]TopicStats, 0, len(topics))
+	for topic := range topics {
+		var pending int64
+		if t, ok := q.topics[topic]; ok {
+			pending = t.pending()
+		}
+
+		stats = append(stats, TopicStats{
+			Topic:       topic,
+			Pending:     pending,
+			DeadLetters: len(q.deadLetters[topic]),
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Topic < stats[j].Topic })
+
+	return stats, nil
+}
+
+// next blocks until there is a message for the consumer group and hands it out.
+func (q *InMemoryQueue) next(ctx context.Context, topic string, group string) (*Envelope, error) {
+	for {
+		q.mu.Lock()
+		t := q.topics[topic]
+		g := t.groups[group]
+		end := t.base + int64(len(t.messages))
+
+		for g.offset < end {
+			message := t.messages[g.offset-t.base]
+			g.offset++
+
+			if message.group == "" || message.group == group {
+				g.inFlight++
+				t.truncate()
+				q.mu.Unlock()
+
+				return message.envelope, nil
+			}
+		}
+
+		t.truncate()
+		appended := t.appended
+		q.mu.Unlock()
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return nil, errConsumerStopped
+		}
+	}
+}
+
+// append must be called with q.mu held.
+func (q *InMemoryQueue) append(topic string, message memoryMessage) {
+	t := q.topic(topic)
+	t.messages = append(t.messages, message)
+	close(t.appended)
+	t.appended = make(chan struct{})
+}
+
+// topic returns the topic with the given name and creates it if necessary. It must be called with q.mu
+// held.
+func (q *InMemoryQueue) topic(name string) *memoryTopic {
+	t, ok := q.topics[name]
 	if !ok {
-		topicChan = make(chan []byte)
-		q.messages[topic] = topicChan
+		t = &memoryTopic{
+			groups:   make(map[string]*memoryGroup),
+			appended: make(chan struct{}),
+			released: make(chan struct{}),
+		}
+		q.topics[name] = t
 	}
-	q.mu.Unlock()
 
-	for message := range topicChan {
-		err := handler(message)
-		if err != nil {
-			fmt.Printf("Error processing message: %v\n", err)
+	return t
+}
+
+// removeDeadLetter must be called with q.mu held.
+func (q *InMemoryQueue) removeDeadLetter(topic string, id string) (*DeadLetter, error) {
+	deadLetters := q.deadLetters[topic]
+	for i, deadLetter := range deadLetters {
+		if deadLetter.ID == id {
+			q.deadLetters[topic] = append(deadLetters[:i:i], deadLetters[i+1:]...)
+			return deadLetter, nil
 		}
 	}
 
-	return nil
+	return nil, ErrDeadLetterNotFound
+}
+
+// truncate drops the messages every consumer group has received.
+func (t *memoryTopic) truncate() {
+	if len(t.groups) == 0 {
+		return
+	}
+
+	minOffset := t.base + int64(len(t.messages))
+	for _, g := range t.groups {
+		minOffset = min(minOffset, g.offset)
+	}
+
+	drop := minOffset - t.base
+	if drop <= 0 {
+		return
+	}
+
+	// Clear the dropped messages, so they can be garbage collected.
+	clear(t.messages[:drop])
+	t.messages = t.messages[drop:]
+	t.base = minOffset
+}
+
+// full reports whether a consumer group reached its in-flight limit.
+func (t *memoryTopic) full() bool {
+	end := t.base + int64(len(t.messages))
+	for _, g := range t.groups {
+		if g.maxInFlight > 0 && end-g.offset+g.inFlight >= g.maxInFlight {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pending returns the number of messages that the consumer group furthest behind has not finished yet.
+func (t *memoryTopic) pending() int64 {
+	end := t.base + int64(len(t.messages))
+	if len(t.groups) == 0 {
+		return end - t.base
+	}
+
+	var pending int64
+	for _, g := range t.groups {
+		pending = max(pending, end-g.offset+g.inFlight)
+	}
+
+	return pending
 }
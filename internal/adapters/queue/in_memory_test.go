@@ -0,0 +1,364 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go-microservices-observability/pkg/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+func TestInMemoryQueue_ConsumerGroups(t *testing.T) {
+	t.Parallel()
+
+	q := NewInMemoryQueue(nil)
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	consume := func(group string, consumer string) {
+		go func() {
+			_ = q.Consume(context.Background(), "orders", func(_ context.Context, message []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received[group] = append(received[group], string(message))
+				received[consumer] = append(received[consumer], string(message))
+				return nil
+			}, WithGroup(group))
+		}()
+	}
+
+	consume("inventory", "inventory-1")
+	consume("inventory", "inventory-2")
+	consume("analytics", "analytics-1")
+	time.Sleep(10 * time.Millisecond)
+
+	for _, message := range []string{"a", "b", "c", "d"} {
+		if err := q.Publish(context.Background(), "orders", []byte(message)); err != nil {
+			t.Fatalf("failed to publish: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(received["inventory"]) == 4 && len(received["analytics"]) == 4
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, group := range []string{"inventory", "analytics"} {
+		messages := received[group]
+		sort.Strings(messages)
+		if len(messages) != 4 || messages[0] != "a" || messages[3] != "d" {
+			t.Errorf("group %s received %v, want every message once", group, messages)
+		}
+	}
+
+	if len(received["inventory-1"])+len(received["inventory-2"]) != 4 {
+		t.Errorf("consumers of a group should share the messages")
+	}
+}
+
+func TestInMemoryQueue_OrderingKeyAndBackpressure(t *testing.T) {
+	t.Parallel()
+
+	q := NewInMemoryQueue(nil)
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	release := make(chan struct{})
+	go func() {
+		_ = q.Consume(context.Background(), "orders", func(_ context.Context, message []byte) error {
+			<-release
+			key := JSONFieldKey("orderId")(message)
+			mu.Lock()
+			defer mu.Unlock()
+			received[key] = append(received[key], string(message))
+			return nil
+		}, WithConcurrency(4), WithOrderingKey(JSONFieldKey("orderId")), WithMaxInFlight(2))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < 3; i++ {
+			for _, orderID := range []string{"a", "b"} {
+				message := map[string]interface{}{"orderId": orderID, "step": i}
+				if err := q.Publish(context.Background(), "orders", message); err != nil {
+					t.Errorf("failed to publish: %v", err)
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-published:
+		t.Fatalf("publish should block while the in-flight limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publish did not continue after messages were finished")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(received["a"]) == 3 && len(received["b"]) == 3
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, orderID := range []string{"a", "b"} {
+		for i, message := range received[orderID] {
+			if want := fmt.Sprintf(`{"orderId":"%s","step":%d}`, orderID, i); message != want {
+				t.Errorf("message %d of order %s is %s, want %s", i, orderID, message, want)
+			}
+		}
+	}
+}
+
+func TestInMemoryQueue_RedeliversWithBackoff(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: 20 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	q := NewInMemoryQueue(&InMemoryQueueConfig{RetryPolicy: policy})
+
+	var mu sync.Mutex
+	var attempts []time.Time
+	go func() {
+		_ = q.Consume(context.Background(), "orders", func(context.Context, []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, time.Now())
+			if len(attempts) < 3 {
+				return errors.New("handler failed")
+			}
+			return nil
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := q.Publish(context.Background(), "orders", []byte("0")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(attempts) == 3
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+	for i := 1; i < len(attempts); i++ {
+		if delay := attempts[i].Sub(attempts[i-1]); delay < policy.Backoff(i+1) {
+			t.Errorf("attempt %d came after %v, want at least %v", i+1, delay, policy.Backoff(i+1))
+		}
+	}
+
+	// The message succeeded on its last attempt, so it isn't dead-lettered.
+	if deadLetters, err := q.DeadLetters("orders"); err != nil || len(deadLetters) != 0 {
+		t.Errorf("expected no dead letters, got %v, %v", deadLetters, err)
+	}
+}
+
+func TestInMemoryQueue_DeadLetterRedriveAndPurge(t *testing.T) {
+	t.Parallel()
+
+	q := NewInMemoryQueue(&InMemoryQueueConfig{
+		RetryPolicy: RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+	})
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	fail := true
+	for _, group := range []string{"billing", "shipping"} {
+		go func() {
+			_ = q.Consume(context.Background(), "orders", func(_ context.Context, message []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received[group] = append(received[group], string(message))
+				if group == "billing" && fail {
+					return errors.New("handler failed")
+				}
+				return nil
+			}, WithGroup(group))
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err := q.Publish(context.Background(), "orders", []byte("0")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	deadLetters := waitForDeadLetters(t, q, "orders", 1)
+	if deadLetters[0].Group != "billing" || deadLetters[0].Attempts != 2 || deadLetters[0].LastError != "handler failed" {
+		t.Fatalf("unexpected dead letter %+v", deadLetters[0])
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	if err := q.Redrive("orders", deadLetters[0].ID); err != nil {
+		t.Fatalf("failed to redrive: %v", err)
+	}
+	waitForDeadLetters(t, q, "orders", 0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(received["billing"]) == 3
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	if fmt.Sprint(received["billing"]) != "[0 0 0]" {
+		t.Errorf("redriven message was not delivered to the failed group: %v", received["billing"])
+	}
+	if fmt.Sprint(received["shipping"]) != "[0]" {
+		t.Errorf("redriven message was delivered to another group: %v", received["shipping"])
+	}
+	fail = true
+	mu.Unlock()
+
+	if err := q.Publish(context.Background(), "orders", []byte("1")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	deadLetters = waitForDeadLetters(t, q, "orders", 1)
+
+	if err := q.PurgeDeadLetter("orders", deadLetters[0].ID); err != nil {
+		t.Fatalf("failed to purge: %v", err)
+	}
+	waitForDeadLetters(t, q, "orders", 0)
+
+	if err := q.PurgeDeadLetter("orders", deadLetters[0].ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("PurgeDeadLetter: expected %v, got %v", ErrDeadLetterNotFound, err)
+	}
+	if err := q.Redrive("orders", deadLetters[0].ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Errorf("Redrive: expected %v, got %v", ErrDeadLetterNotFound, err)
+	}
+}
+
+func TestInMemoryQueue_PublishAfterConsumerStopped(t *testing.T) {
+	t.Parallel()
+
+	q := NewInMemoryQueue(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		_ = q.Consume(ctx, "orders", func(context.Context, []byte) error {
+			return nil
+		}, WithMaxInFlight(1))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-stopped
+
+	// The group doesn't receive the messages until it has a consumer again, so its limit doesn't apply.
+	publishCtx, cancelPublish := context.WithTimeout(context.Background(), time.Second)
+	defer cancelPublish()
+	for i := 0; i < 3; i++ {
+		if err := q.Publish(publishCtx, "orders", []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatalf("publish %d blocked after the consumer stopped: %v", i, err)
+		}
+	}
+}
+
+func TestInMemoryQueue_PropagatesTraceContext(t *testing.T) {
+	t.Parallel()
+
+	exporter := keepSpansExporter{tracetest.NewInMemoryExporter()}
+	tracer := tracing.NewTracer("queue-test", exporter)
+	q := NewInMemoryQueue(&InMemoryQueueConfig{Tracer: tracer})
+
+	ctx, span := tracer.Start(context.Background(), "request")
+	if err := q.Publish(ctx, "orders", []byte("a")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	span.End()
+
+	received := make(chan oteltrace.SpanContext, 1)
+	go func() {
+		_ = q.Consume(context.Background(), "orders", func(ctx context.Context, _ []byte) error {
+			if _, ok := EnvelopeFromContext(ctx); !ok {
+				t.Error("handler context has no envelope")
+			}
+			received <- oteltrace.SpanContextFromContext(ctx)
+			return nil
+		})
+	}()
+
+	var consumerSpan oteltrace.SpanContext
+	select {
+	case consumerSpan = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not consumed")
+	}
+
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatalf("failed to close queue: %v", err)
+	}
+	if err := tracer.Shutdown(); err != nil {
+		t.Fatalf("failed to shut down tracer: %v", err)
+	}
+
+	if consumerSpan.TraceID() != span.SpanContext().TraceID() {
+		t.Errorf("consumer trace %s, want %s", consumerSpan.TraceID(), span.SpanContext().TraceID())
+	}
+
+	kinds := make(map[string]oteltrace.SpanKind)
+	for _, s := range exporter.GetSpans() {
+		kinds[s.Name] = s.SpanKind
+	}
+	if kinds["publish orders"] != oteltrace.SpanKindProducer || kinds["process orders"] != oteltrace.SpanKindConsumer {
+		t.Errorf("got spans %v, want a producer and a consumer span", kinds)
+	}
+}
+
+// keepSpansExporter keeps the exported spans after the tracer is shut down.
+type keepSpansExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keepSpansExporter) Shutdown(context.Context) error {
+	return nil
+}
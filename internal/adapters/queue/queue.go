@@ -1,10 +1,126 @@
 package queue
 
-// Handler is a function that processes messages.
-type Handler func(message []byte) error
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 
-// Queue is an interface for a message queue.
+	"go-microservices-observability/internal/errs"
+)
+
+// DefaultGroup is the consumer group of consumers that don't specify one.
+const DefaultGroup = "default"
+
+var ErrQueueClosed = errs.New(errs.ErrUnavailable, "queue closed")
+
+// errConsumerStopped ends a consumer whose context is cancelled or whose queue is closing.
+var errConsumerStopped = errors.New("consumer stopped")
+var ErrDeadLetterNotFound = errs.New(errs.ErrNotFound, "dead letter not found")
+
+// Handler is a function that processes messages. Returning nil acknowledges the message, returning an
+// error rejects it, so that it is redelivered according to the retry policy of the queue and finally
+// moved to the dead-letter topic. ctx carries the trace context of the publisher with a consumer span
+// and the envelope of the message, see EnvelopeFromContext.
+type Handler func(ctx context.Context, message []byte) error
+
+// Queue is an interface for a message queue with at-least-once delivery. Every consumer group of a topic
+// receives every message, the consumers within a group share the messages.
 type Queue interface {
-	Publish(topic string, message interface{}) error
-	Consume(topic string, handler Handler) error
+	// Publish wraps the message in an Envelope carrying the trace context of ctx and publishes it.
+	Publish(ctx context.Context, topic string, message interface{}) error
+	// Consume passes the messages of a topic to the handler until ctx is cancelled or the queue is
+	// closed. It returns once the in-flight messages are finished.
+	Consume(ctx context.Context, topic string, handler Handler, opts ...ConsumeOption) error
+	// DeadLetters returns the messages of a topic that exceeded the maximum number of attempts.
+	DeadLetters(topic string) ([]*DeadLetter, error)
+	// Redrive publishes a dead-lettered message again to the consumer group it failed in and removes it
+	// from the dead letters.
+	Redrive(topic string, id string) error
+	// PurgeDeadLetter drops a dead-lettered message for good.
+	PurgeDeadLetter(topic string, id string) error
+	// Stats returns the state of every topic, sorted by topic name.
+	Stats() ([]TopicStats, error)
+	// Close stops the consumers from taking new messages and waits until their in-flight messages are
+	// finished or ctx is done. Messages published by the in-flight handlers are still accepted, afterwards
+	// Publish fails with ErrQueueClosed.
+	Close(ctx context.Context) error
+}
+
+// ConsumeOption configures a consumer.
+type ConsumeOption func(*consumeOptions)
+
+type consumeOptions struct {
+	group       string
+	concurrency int
+	orderingKey func(message []byte) string
+	maxInFlight int
+}
+
+// WithGroup sets the consumer group of a consumer. Defaults to DefaultGroup.
+func WithGroup(group string) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.group = group
+	}
+}
+
+// WithConcurrency sets the number of workers that process messages in parallel. Defaults to 1.
+func WithConcurrency(workers int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.concurrency = workers
+	}
+}
+
+// WithOrderingKey keeps messages with the same key in order, while messages with different keys are
+// processed in parallel by the workers.
+func WithOrderingKey(key func(message []byte) string) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.orderingKey = key
+	}
+}
+
+// WithMaxInFlight limits the number of messages of the consumer group that are published but not yet
+// acknowledged or dead-lettered. Publish blocks while the limit is reached. The limit is lifted once the
+// last consumer of the group stopped. Defaults to no limit.
+func WithMaxInFlight(messages int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.maxInFlight = messages
+	}
+}
+
+func newConsumeOptions(opts []ConsumeOption) consumeOptions {
+	o := consumeOptions{group: DefaultGroup, concurrency: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.concurrency < 1 {
+		o.concurrency = 1
+	}
+
+	return o
+}
+
+// TopicStats describes the state of a topic.
+type TopicStats struct {
+	Topic string `json:"topic"`
+	// Pending is the number of published messages that are not acknowledged or dead-lettered yet by the
+	// consumer group that is furthest behind.
+	Pending int64 `json:"pending"`
+	// DeadLetters is the number of messages in the dead-letter topic.
+	DeadLetters int `json:"deadLetters"`
+}
+
+// encodeMessage passes raw bytes through and marshals everything else to JSON.
+func encodeMessage(message interface{}) ([]byte, error) {
+	if m, ok := message.([]byte); ok {
+		return m, nil
+	}
+
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message to JSON: %w", err)
+	}
+
+	return messageBytes, nil
 }
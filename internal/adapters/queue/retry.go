@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const deadLetterSuffix = ".dlq"
+
+// DefaultRetryPolicy is used if no retry policy is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	Multiplier:     2,
+}
+
+// RetryPolicy defines how often and when a message is redelivered after its handler failed.
+type RetryPolicy struct {
+	// MaxAttempts is the number of deliveries before a message is dead-lettered.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first redelivery.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two deliveries.
+	MaxBackoff time.Duration
+	// Multiplier is applied to the delay after every redelivery.
+	Multiplier float64
+}
+
+// Backoff returns the delay before the given attempt, starting at attempt 2 for the first redelivery.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+	for i := 2; i < attempt; i++ {
+		backoff *= p.Multiplier
+		if backoff >= float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+
+	return time.Duration(backoff)
+}
+
+// WithDefaults returns the policy with every unset field taken from defaults.
+func (p RetryPolicy) WithDefaults(defaults RetryPolicy) RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaults.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaults.Multiplier
+	}
+
+	return p
+}
+
+// DeadLetter is a message that could not be processed within the maximum number of attempts.
+type DeadLetter struct {
+	ID        string            `json:"id"`
+	Topic     string            `json:"topic"`
+	Group     string            `json:"group"`
+	Message   []byte            `json:"message"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Attempts  int               `json:"attempts"`
+	LastError string            `json:"lastError"`
+	FailedAt  time.Time         `json:"failedAt"`
+}
+
+// DeadLetterTopic returns the name of the topic failed messages of the given topic are moved to.
+func DeadLetterTopic(topic string) string {
+	return topic + deadLetterSuffix
+}
+
+func newDeadLetter(topic string, group string, envelope *Envelope, attempts int, err error) *DeadLetter {
+	return &DeadLetter{
+		ID:        uuid.New().String(),
+		Topic:     topic,
+		Group:     group,
+		Message:   envelope.Body,
+		Headers:   envelope.Headers,
+		Attempts:  attempts,
+		LastError: err.Error(),
+		FailedAt:  time.Now(),
+	}
+}
+
+// deliver calls process until the message is acknowledged by returning nil or the maximum number of
+// attempts is reached. It returns the number of attempts and the last error of process. If ctx is done
+// while waiting for a redelivery, errConsumerStopped is returned and the message is neither acknowledged
+// nor dead-lettered.
+func deliver(ctx context.Context, process func() error, policy RetryPolicy) (int, error) {
+	var err error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(policy.Backoff(attempt)):
+			case <-ctx.Done():
+				return attempt - 1, errConsumerStopped
+			}
+		}
+
+		err = process()
+		if err == nil {
+			return attempt, nil
+		}
+
+		fmt.Printf("Error processing message (attempt %d/%d): %v\n", attempt, policy.MaxAttempts, err)
+	}
+
+	return policy.MaxAttempts, err
+}
+
+// envelope wraps the dead-lettered message for redelivery with the headers it was published with.
+func (d *DeadLetter) envelope() *Envelope {
+	return &Envelope{
+		ID:          uuid.New().String(),
+		PublishedAt: time.Now(),
+		Headers:     d.Headers,
+		Body:        d.Message,
+	}
+}
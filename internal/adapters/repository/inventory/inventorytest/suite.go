@@ -0,0 +1,387 @@
+// Package inventorytest provides a conformance test suite for implementations of inventory.Repository.
+package inventorytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go-microservices-observability/internal/adapters/repository/inventory"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
+)
+
+// RepositoryFactory creates an empty repository for a single test.
+type RepositoryFactory func(t *testing.T) inventory.Repository
+
+// RunRepositorySuite runs the tests every inventory.Repository has to pass against the repositories
+// created by newRepository.
+func RunRepositorySuite(t *testing.T, newRepository RepositoryFactory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo inventory.Repository)
+	}{
+		{"CRUD", testCRUD},
+		{"NotFound", testNotFound},
+		{"AlreadyExists", testAlreadyExists},
+		{"NegativeQuantity", testNegativeQuantity},
+		{"VersionConflict", testVersionConflict},
+		{"UpdateKeepsReserved", testUpdateKeepsReserved},
+		{"ReserveAndCommit", testReserveAndCommit},
+		{"ReserveAndRelease", testReserveAndRelease},
+		{"ReserveAllOrNothing", testReserveAllOrNothing},
+		{"ReservationAlreadyExists", testReservationAlreadyExists},
+		{"ReservationClosed", testReservationClosed},
+		{"ConcurrentReservations", testConcurrentReservations},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tt.test(t, newRepository(t))
+		})
+	}
+}
+
+func testCRUD(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+
+	// Reserved items are only tracked by reservations, a new product has none.
+	created := &domain.Product{ID: "product-1", Name: "Keyboard", Quantity: 3, Reserved: 2}
+	if err := repo.Create(ctx, created); err != nil {
+		t.Fatalf("failed to create product: %v", err)
+	}
+	if created.Version != 1 || created.Reserved != 0 {
+		t.Fatalf("expected version 1 and nothing reserved of a new product, got %+v", *created)
+	}
+	assertProduct(
+		t,
+		mustGet(t, repo, "product-1"),
+		domain.Product{ID: "product-1", Name: "Keyboard", Quantity: 3, Version: 1},
+	)
+
+	updated := &domain.Product{ID: "product-1", Name: "Mechanical keyboard", Quantity: 5, Version: 1}
+	if err := repo.Update(ctx, updated); err != nil {
+		t.Fatalf("failed to update product: %v", err)
+	}
+	if updated.Version != 2 {
+		t.Fatalf("expected version 2 after an update, got %d", updated.Version)
+	}
+	assertProduct(
+		t,
+		mustGet(t, repo, "product-1"),
+		domain.Product{ID: "product-1", Name: "Mechanical keyboard", Quantity: 5, Version: 2},
+	)
+
+	createProduct(t, repo, "product-2", 1)
+	products, err := repo.List(ctx)
+	if err != nil {
+		t.Fatalf("failed to list products: %v", err)
+	}
+	if len(products) != 2 {
+		t.Fatalf("expected 2 products, got %d", len(products))
+	}
+
+	if err := repo.Delete(ctx, "product-1"); err != nil {
+		t.Fatalf("failed to delete product: %v", err)
+	}
+	if _, err := repo.Get(ctx, "product-1"); !errors.Is(err, inventory.ErrProductNotFound) {
+		t.Fatalf("expected %v after delete, got %v", inventory.ErrProductNotFound, err)
+	}
+}
+
+func testNotFound(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+
+	if _, err := repo.Get(ctx, "missing"); !errors.Is(err, inventory.ErrProductNotFound) {
+		t.Errorf("Get: expected %v, got %v", inventory.ErrProductNotFound, err)
+	}
+	err := repo.Update(ctx, &domain.Product{ID: "missing", Version: 1})
+	if !errors.Is(err, inventory.ErrProductNotFound) {
+		t.Errorf("Update: expected %v, got %v", inventory.ErrProductNotFound, err)
+	}
+	if err := repo.Delete(ctx, "missing"); !errors.Is(err, inventory.ErrProductNotFound) {
+		t.Errorf("Delete: expected %v, got %v", inventory.ErrProductNotFound, err)
+	}
+}
+
+func testAlreadyExists(t *testing.T, repo inventory.Repository) {
+	createProduct(t, repo, "product-1", 3)
+
+	err := repo.Create(context.Background(), &domain.Product{ID: "product-1", Name: "Other", Quantity: 7})
+	if !errors.Is(err, inventory.ErrProductAlreadyExists) {
+		t.Fatalf("expected %v, got %v", inventory.ErrProductAlreadyExists, err)
+	}
+
+	// The existing product is left unchanged.
+	assertProduct(
+		t,
+		mustGet(t, repo, "product-1"),
+		domain.Product{ID: "product-1", Name: "product-1", Quantity: 3, Version: 1},
+	)
+}
+
+func testNegativeQuantity(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+
+	err := repo.Create(ctx, &domain.Product{ID: "product-1", Name: "Keyboard", Quantity: -1})
+	if !errors.Is(err, inventory.ErrNegativeQuantity) || !errors.Is(err, errs.ErrValidation) {
+		t.Fatalf("Create: expected %v, got %v", inventory.ErrNegativeQuantity, err)
+	}
+	if _, err := repo.Get(ctx, "product-1"); !errors.Is(err, inventory.ErrProductNotFound) {
+		t.Fatalf("expected the product not to be created, got %v", err)
+	}
+
+	createProduct(t, repo, "product-1", 3)
+	err = repo.Update(ctx, &domain.Product{ID: "product-1", Quantity: -1, Version: 1})
+	if !errors.Is(err, inventory.ErrNegativeQuantity) {
+		t.Fatalf("Update: expected %v, got %v", inventory.ErrNegativeQuantity, err)
+	}
+	assertProduct(
+		t,
+		mustGet(t, repo, "product-1"),
+		domain.Product{ID: "product-1", Name: "product-1", Quantity: 3, Version: 1},
+	)
+}
+
+func testVersionConflict(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+	createProduct(t, repo, "product-1", 3)
+
+	if err := repo.Update(ctx, &domain.Product{ID: "product-1", Quantity: 4, Version: 1}); err != nil {
+		t.Fatalf("failed to update product: %v", err)
+	}
+
+	// The second update is based on the version the first one replaced.
+	err := repo.Update(ctx, &domain.Product{ID: "product-1", Quantity: 5, Version: 1})
+	var conflict *inventory.VersionConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, inventory.ErrVersionConflict) {
+		t.Fatalf("expected a version conflict, got %v", err)
+	}
+	if conflict.ProductID != "product-1" || conflict.Version != 1 || conflict.StoredVersion != 2 {
+		t.Fatalf("unexpected conflict: %+v", *conflict)
+	}
+
+	assertProduct(t, mustGet(t, repo, "product-1"), domain.Product{ID: "product-1", Quantity: 4, Version: 2})
+}
+
+func testUpdateKeepsReserved(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+	createProduct(t, repo, "product-1", 3)
+	mustReserve(t, repo, "order-1", map[string]int{"product-1": 2})
+
+	// Reserved stock is owned by the reservation, an update only changes the stock on hand.
+	version := mustGet(t, repo, "product-1").Version
+	err := repo.Update(ctx, &domain.Product{ID: "product-1", Name: "product-1", Quantity: 10, Version: version})
+	if err != nil {
+		t.Fatalf("failed to update product: %v", err)
+	}
+
+	assertProduct(
+		t,
+		mustGet(t, repo, "product-1"),
+		domain.Product{ID: "product-1", Name: "product-1", Quantity: 10, Reserved: 2, Version: version + 1},
+	)
+}
+
+func testReserveAndCommit(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+	createProduct(t, repo, "product-1", 3)
+	createProduct(t, repo, "product-2", 1)
+
+	mustReserve(t, repo, "order-1", map[string]int{"product-1": 2, "product-2": 1})
+	assertStock(t, repo, "product-1", 1, 2)
+	assertStock(t, repo, "product-2", 0, 1)
+	if version := mustGet(t, repo, "product-1").Version; version != 2 {
+		t.Fatalf("expected version 2 after a reservation, got %d", version)
+	}
+
+	if err := repo.Commit(ctx, "order-1"); err != nil {
+		t.Fatalf("failed to commit reservation: %v", err)
+	}
+	assertStock(t, repo, "product-1", 1, 0)
+	assertStock(t, repo, "product-2", 0, 0)
+}
+
+func testReserveAndRelease(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+	createProduct(t, repo, "product-1", 3)
+	createProduct(t, repo, "product-2", 1)
+
+	mustReserve(t, repo, "order-1", map[string]int{"product-1": 2, "product-2": 1})
+
+	// A product removed in the meantime doesn't prevent the rest of the reservation from being released.
+	if err := repo.Delete(ctx, "product-2"); err != nil {
+		t.Fatalf("failed to delete product: %v", err)
+	}
+
+	if err := repo.Release(ctx, "order-1"); err != nil {
+		t.Fatalf("failed to release reservation: %v", err)
+	}
+	assertStock(t, repo, "product-1", 3, 0)
+}
+
+func testReserveAllOrNothing(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+	createProduct(t, repo, "product-1", 3)
+	createProduct(t, repo, "product-2", 1)
+
+	err := repo.Reserve(ctx, "order-1", map[string]int{"product-1": 2, "product-2": 2})
+	if !errors.Is(err, inventory.ErrInsufficientStock) {
+		t.Fatalf("expected %v, got %v", inventory.ErrInsufficientStock, err)
+	}
+
+	err = repo.Reserve(ctx, "order-2", map[string]int{"product-1": 2, "missing": 1})
+	if !errors.Is(err, inventory.ErrProductNotFound) {
+		t.Fatalf("expected %v, got %v", inventory.ErrProductNotFound, err)
+	}
+
+	assertStock(t, repo, "product-1", 3, 0)
+	assertStock(t, repo, "product-2", 1, 0)
+
+	// A rejected reservation is not stored.
+	if err := repo.Release(ctx, "order-1"); !errors.Is(err, inventory.ErrReservationNotFound) {
+		t.Fatalf("expected %v, got %v", inventory.ErrReservationNotFound, err)
+	}
+}
+
+func testReservationAlreadyExists(t *testing.T, repo inventory.Repository) {
+	createProduct(t, repo, "product-1", 3)
+	mustReserve(t, repo, "order-1", map[string]int{"product-1": 1})
+
+	err := repo.Reserve(context.Background(), "order-1", map[string]int{"product-1": 1})
+	if !errors.Is(err, inventory.ErrReservationAlreadyExists) {
+		t.Fatalf("expected %v, got %v", inventory.ErrReservationAlreadyExists, err)
+	}
+
+	assertStock(t, repo, "product-1", 2, 1)
+}
+
+func testReservationClosed(t *testing.T, repo inventory.Repository) {
+	ctx := context.Background()
+	createProduct(t, repo, "product-1", 3)
+	mustReserve(t, repo, "order-1", map[string]int{"product-1": 1})
+	mustReserve(t, repo, "order-2", map[string]int{"product-1": 1})
+
+	if err := repo.Commit(ctx, "order-1"); err != nil {
+		t.Fatalf("failed to commit reservation: %v", err)
+	}
+	if err := repo.Release(ctx, "order-2"); err != nil {
+		t.Fatalf("failed to release reservation: %v", err)
+	}
+
+	// A reservation is closed only once, and closing it again tells how it was closed.
+	if err := repo.Commit(ctx, "order-1"); !errors.Is(err, inventory.ErrReservationCommitted) {
+		t.Errorf("Commit: expected %v, got %v", inventory.ErrReservationCommitted, err)
+	}
+	if err := repo.Release(ctx, "order-1"); !errors.Is(err, inventory.ErrReservationCommitted) {
+		t.Errorf("Release: expected %v, got %v", inventory.ErrReservationCommitted, err)
+	}
+	if err := repo.Commit(ctx, "order-2"); !errors.Is(err, inventory.ErrReservationReleased) {
+		t.Errorf("Commit: expected %v, got %v", inventory.ErrReservationReleased, err)
+	}
+	if err := repo.Release(ctx, "order-2"); !errors.Is(err, inventory.ErrReservationReleased) {
+		t.Errorf("Release: expected %v, got %v", inventory.ErrReservationReleased, err)
+	}
+	if err := repo.Release(ctx, "order-3"); !errors.Is(err, inventory.ErrReservationNotFound) {
+		t.Errorf("Release: expected %v, got %v", inventory.ErrReservationNotFound, err)
+	}
+
+	// The ID of a closed reservation can't be reserved again.
+	err := repo.Reserve(ctx, "order-1", map[string]int{"product-1": 1})
+	if !errors.Is(err, inventory.ErrReservationAlreadyExists) {
+		t.Errorf("Reserve: expected %v, got %v", inventory.ErrReservationAlreadyExists, err)
+	}
+	assertStock(t, repo, "product-1", 2, 0)
+}
+
+func testConcurrentReservations(t *testing.T, repo inventory.Repository) {
+	const stock = 10
+	createProduct(t, repo, "product-1", stock)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := range 2 * stock {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reservationID := fmt.Sprintf("order-%d", i)
+			err := inventory.ErrVersionConflict
+			for errors.Is(err, inventory.ErrVersionConflict) {
+				err = repo.Reserve(context.Background(), reservationID, map[string]int{"product-1": 1})
+			}
+
+			switch {
+			case err == nil:
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			case !errors.Is(err, inventory.ErrInsufficientStock):
+				t.Errorf("failed to reserve: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != stock {
+		t.Fatalf("expected %d reservations, got %d", stock, reserved)
+	}
+	assertStock(t, repo, "product-1", 0, stock)
+}
+
+func createProduct(t *testing.T, repo inventory.Repository, id string, quantity int) {
+	t.Helper()
+
+	err := repo.Create(context.Background(), &domain.Product{ID: id, Name: id, Quantity: quantity})
+	if err != nil {
+		t.Fatalf("failed to create product %s: %v", id, err)
+	}
+}
+
+func mustGet(t *testing.T, repo inventory.Repository, id string) *domain.Product {
+	t.Helper()
+
+	product, err := repo.Get(context.Background(), id)
+	if err != nil {
+		t.Fatalf("failed to get product %s: %v", id, err)
+	}
+
+	return product
+}
+
+func mustReserve(t *testing.T, repo inventory.Repository, reservationID string, quantities map[string]int) {
+	t.Helper()
+
+	if err := repo.Reserve(context.Background(), reservationID, quantities); err != nil {
+		t.Fatalf("failed to reserve %v: %v", quantities, err)
+	}
+}
+
+func assertProduct(t *testing.T, got *domain.Product, want domain.Product) {
+	t.Helper()
+
+	if *got != want {
+		t.Fatalf("expected product %+v, got %+v", want, *got)
+	}
+}
+
+func assertStock(t *testing.T, repo inventory.Repository, id string, quantity int, reserved int) {
+	t.Helper()
+
+	product := mustGet(t, repo, id)
+	if product.Quantity != quantity || product.Reserved != reserved {
+		t.Fatalf(
+			"expected product %s to have %d on hand and %d reserved, got %d and %d",
+			id,
+			quantity,
+			reserved,
+			product.Quantity,
+			product.Reserved,
+		)
+	}
+}
@@ -0,0 +1,19 @@
+CREATE TABLE products (
+    id       TEXT PRIMARY KEY,
+    name     TEXT NOT NULL,
+    quantity INTEGER NOT NULL,
+    reserved INTEGER NOT NULL DEFAULT 0,
+    version  INTEGER NOT NULL
+);
+
+CREATE TABLE reservations (
+    id TEXT PRIMARY KEY
+);
+
+-- Items of a reservation are kept when their product is deleted, there is just nothing to give back.
+CREATE TABLE reservation_items (
+    reservation_id TEXT NOT NULL REFERENCES reservations (id) ON DELETE CASCADE,
+    product_id     TEXT NOT NULL,
+    quantity       INTEGER NOT NULL,
+    PRIMARY KEY (reservation_id, product_id)
+);
@@ -0,0 +1,2 @@
+-- Closed reservations are kept with their status, so closing them again is told apart from unknown reservations.
+ALTER TABLE reservations ADD COLUMN status TEXT NOT NULL DEFAULT 'RESERVED';
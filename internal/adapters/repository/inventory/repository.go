@@ -2,40 +2,100 @@ package inventory
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
 	"sync"
 )
 
-var ErrProductNotFound = errors.New("product not found")
+var ErrProductNotFound = errs.New(errs.ErrNotFound, "product not found")
+var ErrInsufficientStock = errs.New(errs.ErrConflict, "insufficient stock")
+var ErrReservationNotFound = errs.New(errs.ErrNotFound, "reservation not found")
+var ErrReservationAlreadyExists = errs.New(errs.ErrAlreadyExists, "reservation already exists")
+var ErrReservationReleased = errs.New(errs.ErrConflict, "reservation already released")
+var ErrReservationCommitted = errs.New(errs.ErrConflict, "reservation already committed")
+var ErrProductAlreadyExists = errs.New(errs.ErrAlreadyExists, "product already exists")
+
+// ErrNegativeQuantity is returned when a product is stored with a negative on-hand quantity.
+var ErrNegativeQuantity = errs.New(errs.ErrValidation, "quantity must not be negative")
+
+// ErrVersionConflict is wrapped by VersionConflictError.
+var ErrVersionConflict = errs.New(errs.ErrConflict, "version conflict")
+
+// VersionConflictError is returned when a product is changed based on a stale version.
+type VersionConflictError struct {
+	ProductID string
+	// Version is the version the change was based on.
+	Version int
+	// StoredVersion is the current version of the product.
+	StoredVersion int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf(
+		"%v: product %s has version %d, update is based on version %d",
+		ErrVersionConflict,
+		e.ProductID,
+		e.StoredVersion,
+		e.Version,
+	)
+}
+
+func (e *VersionConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
 
 type Repository interface {
 	Get(ctx context.Context, id string) (*domain.Product, error)
 	List(ctx context.Context) ([]*domain.Product, error)
+	// Create stores a new product with version 1. A negative quantity is rejected with ErrNegativeQuantity.
 	Create(ctx context.Context, product *domain.Product) error
+	// Update replaces the product if its Version is the stored version, otherwise it returns a
+	// *VersionConflictError. The version of product is incremented. A negative quantity is rejected with
+	// ErrNegativeQuantity.
 	Update(ctx context.Context, product *domain.Product) error
 	Delete(ctx context.Context, id string) error
+	// Reserve moves the given quantities per product ID from on-hand to reserved stock. Either all
+	// quantities are reserved or none is. Reserve, Release and Commit increment the version of the
+	// products they change.
+	Reserve(ctx context.Context, reservationID string, quantities map[string]int) error
+	// Release returns the reserved quantities of a reservation to on-hand stock. A reservation is closed by
+	// either Release or Commit, closing it again returns ErrReservationReleased or ErrReservationCommitted.
+	Release(ctx context.Context, reservationID string) error
+	// Commit finally deducts the reserved quantities of a reservation.
+	Commit(ctx context.Context, reservationID string) error
 }
 
 type repository struct {
-	mu       sync.RWMutex
-	products map[string]*domain.Product
+	mu           sync.RWMutex
+	products     map[string]*domain.Product
+	reservations map[string]map[string]int
+	// closed maps the closed reservations to the error of closing them again.
+	closed map[string]error
 }
 
 func NewRepository() Repository {
 	return &repository{
-		products: make(map[string]*domain.Product),
+		products:     make(map[string]*domain.Product),
+		reservations: make(map[string]map[string]int),
+		closed:       make(map[string]error),
 	}
 }
 
 func (r *repository) Create(ctx context.Context, product *domain.Product) error {
+	if product.Quantity < 0 {
+		return ErrNegativeQuantity
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if _, exists := r.products[product.ID]; exists {
-		return ErrProductNotFound
+		return ErrProductAlreadyExists
 	}
 
+	product.Reserved = 0
+	product.Version = 1
 	r.products[product.ID] = product
 
 	return nil
@@ -54,13 +114,29 @@ func (r *repository) Get(ctx context.Context, id string) (*domain.Product, error
 }
 
 func (r *repository) Update(ctx context.Context, product *domain.Product) error {
+	if product.Quantity < 0 {
+		return ErrNegativeQuantity
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, exists := r.products[product.ID]; !exists {
+	stored, exists := r.products[product.ID]
+	if !exists {
 		return ErrProductNotFound
 	}
 
+	if product.Version != stored.Version {
+		return &VersionConflictError{
+			ProductID:     product.ID,
+			Version:       product.Version,
+			StoredVersion: stored.Version,
+		}
+	}
+
+	// Reserved stock is owned by the open reservations and can't be overwritten.
+	product.Reserved = stored.Reserved
+	product.Version++
 	r.products[product.ID] = product
 
 	return nil
@@ -90,3 +166,102 @@ func (r *repository) List(ctx context.Context) ([]*domain.Product, error) {
 
 	return products, nil
 }
+
+func (r *repository) Reserve(ctx context.Context, reservationID string, quantities map[string]int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.reservations[reservationID]; exists || r.closed[reservationID] != nil {
+		return ErrReservationAlreadyExists
+	}
+
+	// Check every product first, so that nothing is reserved if a single product is short.
+	for id, quantity := range quantities {
+		product, exists := r.products[id]
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrProductNotFound, id)
+		}
+
+		if product.Quantity < quantity {
+			return fmt.Errorf("%w: product %s has %d, requested %d", ErrInsufficientStock, id, product.Quantity, quantity)
+		}
+	}
+
+	reserved := make(map[string]int, len(quantities))
+	for id, quantity := range quantities {
+		product := *r.products[id]
+		product.Quantity -= quantity
+		product.Reserved += quantity
+		product.Version++
+		r.products[id] = &product
+		reserved[id] = quantity
+	}
+
+	r.reservations[reservationID] = reserved
+
+	return nil
+}
+
+func (r *repository) Release(ctx context.Context, reservationID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.closed[reservationID]; err != nil {
+		return err
+	}
+
+	reserved, exists := r.reservations[reservationID]
+	if !exists {
+		return ErrReservationNotFound
+	}
+
+	for id, quantity := range reserved {
+		stored, exists := r.products[id]
+		if !exists {
+			// The product has been removed from the catalog in the meantime, nothing to give back.
+			continue
+		}
+
+		product := *stored
+		product.Quantity += quantity
+		product.Reserved -= quantity
+		product.Version++
+		r.products[id] = &product
+	}
+
+	delete(r.reservations, reservationID)
+	r.closed[reservationID] = ErrReservationReleased
+
+	return nil
+}
+
+func (r *repository) Commit(ctx context.Context, reservationID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.closed[reservationID]; err != nil {
+		return err
+	}
+
+	reserved, exists := r.reservations[reservationID]
+	if !exists {
+		return ErrReservationNotFound
+	}
+
+	for id, quantity := range reserved {
+		stored, exists := r.products[id]
+		if !exists {
+			continue
+		}
+
+		product := *stored
+		product.Reserved -= quantity
+		product.Version++
+		r.products[id] = &product
+	}
+
+	delete(r.reservations, reservationID)
+	r.closed[reservationID] = ErrReservationCommitted
+
+	return nil
+}
@@ -0,0 +1,14 @@
+package inventory_test
+
+import (
+	"testing"
+
+	"go-microservices-observability/internal/adapters/repository/inventory"
+	"go-microservices-observability/internal/adapters/repository/inventory/inventorytest"
+)
+
+func TestRepository(t *testing.T) {
+	inventorytest.RunRepositorySuite(t, func(t *testing.T) inventory.Repository {
+		return inventory.NewRepository()
+	})
+}
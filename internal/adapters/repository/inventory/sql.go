@@ -0,0 +1,344 @@
+package inventory
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"go-microservices-observability/internal/adapters/repository/sqldb"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/pkg/tracing"
+	"io/fs"
+	"maps"
+	"slices"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// The statuses of reservations.
+const (
+	reservationReserved  = "RESERVED"
+	reservationReleased  = "RELEASED"
+	reservationCommitted = "COMMITTED"
+)
+
+type sqlRepository struct {
+	db     *sql.DB
+	q      sqldb.Querier
+	tracer tracing.Tracer
+}
+
+// NewSQLRepository creates an inventory repository stored in db and migrates its schema. Changes of a
+// product are conditional on its version, so several instances can share the database.
+func NewSQLRepository(ctx context.Context, db *sql.DB, tracer tracing.Tracer) (Repository, error) {
+	sub, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sqldb.Migrate(ctx, db, "inventory", sub); err != nil {
+		return nil, err
+	}
+
+	return &sqlRepository{
+		db:     db,
+		q:      sqldb.Trace(db, tracer),
+		tracer: tracer,
+	}, nil
+}
+
+func (r *sqlRepository) Create(ctx context.Context, product *domain.Product) error {
+	if product.Quantity < 0 {
+		return ErrNegativeQuantity
+	}
+
+	_, err := r.q.ExecContext(
+		ctx,
+		"INSERT INTO products (id, name, quantity, reserved, version) VALUES (?, ?, ?, 0, 1)",
+		product.ID,
+		product.Name,
+		product.Quantity,
+	)
+	if sqldb.IsUniqueViolation(err) {
+		return ErrProductAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+
+	product.Reserved = 0
+	product.Version = 1
+
+	return nil
+}
+
+func (r *sqlRepository) Get(ctx context.Context, id string) (*domain.Product, error) {
+	var product domain.Product
+	err := r.q.QueryRowContext(
+		ctx,
+		"SELECT id, name, quantity, reserved, version FROM products WHERE id = ?",
+		id,
+	).Scan(&product.ID, &product.Name, &product.Quantity, &product.Reserved, &product.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &product, nil
+}
+
+func (r *sqlRepository) Update(ctx context.Context, product *domain.Product) error {
+	if product.Quantity < 0 {
+		return ErrNegativeQuantity
+	}
+
+	// Reserved stock is owned by the open reservations and can't be overwritten.
+	err := r.q.QueryRowContext(
+		ctx,
+		`UPDATE products SET name = ?, quantity = ?, version = version + 1 WHERE id = ? AND version = ?
+		RETURNING reserved, version`,
+		product.Name,
+		product.Quantity,
+		product.ID,
+		product.Version,
+	).Scan(&product.Reserved, &product.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return versionConflict(ctx, r.q, product.ID, product.Version)
+	}
+
+	return err
+}
+
+func (r *sqlRepository) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM products WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrProductNotFound
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) List(ctx context.Context) ([]*domain.Product, error) {
+	rows, err := r.q.QueryContext(ctx, "SELECT id, name, quantity, reserved, version FROM products ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := make([]*domain.Product, 0)
+	for rows.Next() {
+		var product domain.Product
+		if err := rows.Scan(&product.ID, &product.Name, &product.Quantity, &product.Reserved, &product.Version); err != nil {
+			return nil, err
+		}
+		products = append(products, &product)
+	}
+
+	return products, rows.Err()
+}
+
+func (r *sqlRepository) Reserve(ctx context.Context, reservationID string, quantities map[string]int) error {
+	return r.withinTx(ctx, func(q sqldb.Querier) error {
+		_, err := q.ExecContext(ctx, "INSERT INTO reservations (id) VALUES (?)", reservationID)
+		if sqldb.IsUniqueViolation(err) {
+			return ErrReservationAlreadyExists
+		}
+		if err != nil {
+			return err
+		}
+
+		// Check every product first, so that nothing is reserved if a single product is short.
+		ids := slices.Sorted(maps.Keys(quantities))
+		versions := make(map[string]int, len(ids))
+		for _, id := range ids {
+			var onHand, version int
+			err := q.QueryRowContext(ctx, "SELECT quantity, version FROM products WHERE id = ?", id).
+				Scan(&onHand, &version)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%w: %s", ErrProductNotFound, id)
+			}
+			if err != nil {
+				return err
+			}
+
+			if onHand < quantities[id] {
+				return fmt.Errorf("%w: product %s has %d, requested %d", ErrInsufficientStock, id, onHand, quantities[id])
+			}
+			versions[id] = version
+		}
+
+		for _, id := range ids {
+			result, err := q.ExecContext(
+				ctx,
+				`UPDATE products SET quantity = quantity - ?1, reserved = reserved + ?1, version = version + 1
+				WHERE id = ?2 AND version = ?3`,
+				quantities[id],
+				id,
+				versions[id],
+			)
+			if err != nil {
+				return err
+			}
+			updated, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if updated == 0 {
+				return versionConflict(ctx, q, id, versions[id])
+			}
+
+			_, err = q.ExecContext(
+				ctx,
+				"INSERT INTO reservation_items (reservation_id, product_id, quantity) VALUES (?, ?, ?)",
+				reservationID,
+				id,
+				quantities[id],
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *sqlRepository) Release(ctx context.Context, reservationID string) error {
+	return r.withinTx(ctx, func(q sqldb.Querier) error {
+		return closeReservation(
+			ctx,
+			q,
+			reservationID,
+			reservationReleased,
+			`UPDATE products SET quantity = quantity + ?1, reserved = reserved - ?1, version = version + 1
+			WHERE id = ?2`,
+		)
+	})
+}
+
+func (r *sqlRepository) Commit(ctx context.Context, reservationID string) error {
+	return r.withinTx(ctx, func(q sqldb.Querier) error {
+		return closeReservation(
+			ctx,
+			q,
+			reservationID,
+			reservationCommitted,
+			"UPDATE products SET reserved = reserved - ?1, version = version + 1 WHERE id = ?2",
+		)
+	})
+}
+
+// closeReservation applies update to every product of an open reservation and sets its status. update
+// takes the reserved quantity as ?1 and the product ID as ?2.
+func closeReservation(
+	ctx context.Context,
+	q sqldb.Querier,
+	reservationID string,
+	status string,
+	update string,
+) error {
+	var current string
+	err := q.QueryRowContext(ctx, "SELECT status FROM reservations WHERE id = ?", reservationID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrReservationNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	switch current {
+	case reservationReleased:
+		return ErrReservationReleased
+	case reservationCommitted:
+		return ErrReservationCommitted
+	}
+
+	rows, err := q.QueryContext(
+		ctx,
+		"SELECT product_id, quantity FROM reservation_items WHERE reservation_id = ? ORDER BY product_id",
+		reservationID,
+	)
+	if err != nil {
+		return err
+	}
+
+	reserved := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var quantity int
+		if err := rows.Scan(&id, &quantity); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		reserved[id] = quantity
+	}
+	if err := errors.Join(rows.Err(), rows.Close()); err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, "UPDATE reservations SET status = ? WHERE id = ?", status, reservationID)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "DELETE FROM reservation_items WHERE reservation_id = ?", reservationID)
+	if err != nil {
+		return err
+	}
+
+	// A product that has been removed from the catalog in the meantime is not updated, nothing to give back.
+	for _, id := range slices.Sorted(maps.Keys(reserved)) {
+		if _, err := q.ExecContext(ctx, update, reserved[id], id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// versionConflict returns the error of a change of a product that was not based on its stored version.
+func versionConflict(ctx context.Context, q sqldb.Querier, id string, version int) error {
+	var storedVersion int
+	err := q.QueryRowContext(ctx, "SELECT version FROM products WHERE id = ?", id).Scan(&storedVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrProductNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return &VersionConflictError{
+		ProductID:     id,
+		Version:       version,
+		StoredVersion: storedVersion,
+	}
+}
+
+func (r *sqlRepository) withinTx(ctx context.Context, fn func(q sqldb.Querier) error) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := fn(sqldb.Trace(tx, r.tracer)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
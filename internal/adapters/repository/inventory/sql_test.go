@@ -0,0 +1,33 @@
+package inventory_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go-microservices-observability/internal/adapters/repository/inventory"
+	"go-microservices-observability/internal/adapters/repository/inventory/inventorytest"
+	"go-microservices-observability/internal/adapters/repository/sqldb"
+	"go-microservices-observability/pkg/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSQLRepository(t *testing.T) {
+	tracer := tracing.NewTracer("test", tracetest.NewInMemoryExporter())
+
+	inventorytest.RunRepositorySuite(t, func(t *testing.T) inventory.Repository {
+		db, err := sqldb.Open(filepath.Join(t.TempDir(), "inventory.db"))
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+
+		repo, err := inventory.NewSQLRepository(context.Background(), db, tracer)
+		if err != nil {
+			t.Fatalf("failed to create repository: %v", err)
+		}
+
+		return repo
+	})
+}
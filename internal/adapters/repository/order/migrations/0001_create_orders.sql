@@ -0,0 +1,24 @@
+CREATE TABLE orders (
+    id            TEXT PRIMARY KEY,
+    customer_id   TEXT NOT NULL,
+    product_ids   TEXT NOT NULL,
+    status        TEXT NOT NULL,
+    status_reason TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE outbox_messages (
+    id              TEXT PRIMARY KEY,
+    topic           TEXT NOT NULL,
+    message         BLOB NOT NULL,
+    headers         TEXT NOT NULL DEFAULT '{}',
+    created_at      INTEGER NOT NULL,
+    status          TEXT NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    last_error      TEXT NOT NULL DEFAULT '',
+    next_attempt_at INTEGER NOT NULL DEFAULT 0,
+    processed_at    INTEGER NOT NULL DEFAULT 0,
+    claimed_by      TEXT NOT NULL DEFAULT '',
+    lease_until     INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX outbox_messages_status_created_at ON outbox_messages (status, created_at);
@@ -0,0 +1,652 @@
+// Package ordertest provides a conformance test suite for implementations of order.Repository.
+package ordertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go-microservices-observability/internal/adapters/repository/order"
+	"go-microservices-observability/internal/domain"
+)
+
+// RepositoryFactory creates an empty repository for a single test.
+type RepositoryFactory func(t *testing.T) order.Repository
+
+// RunRepositorySuite runs the tests every order.Repository has to pass against the repositories created
+// by newRepository.
+func RunRepositorySuite(t *testing.T, newRepository RepositoryFactory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo order.Repository)
+	}{
+		{"CRUD", testCRUD},
+		{"NotFound", testNotFound},
+		{"AlreadyExists", testAlreadyExists},
+		{"OutboxProcessed", testOutboxProcessed},
+		{"OutboxRetried", testOutboxRetried},
+		{"OutboxFailed", testOutboxFailed},
+		{"OutboxMessageNotFound", testOutboxMessageNotFound},
+		{"OutboxOrderPerTopic", testOutboxOrderPerTopic},
+		{"OutboxLease", testOutboxLease},
+		{"OutboxLeaseLost", testOutboxLeaseLost},
+		{"OutboxPurge", testOutboxPurge},
+		{"OutboxSignal", testOutboxSignal},
+		{"OutboxBacklog", testOutboxBacklog},
+		{"OutboxRoundTrip", testOutboxRoundTrip},
+		{"TxCommit", testTxCommit},
+		{"TxRollback", testTxRollback},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"ConcurrentClaims", testConcurrentClaims},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tt.test(t, newRepository(t))
+		})
+	}
+}
+
+func testCRUD(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+
+	created := newOrder("order-1")
+	if err := repo.Create(ctx, created); err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+
+	got := mustGet(t, repo, "order-1")
+	assertOrder(t, got, created)
+
+	updated := newOrder("order-1")
+	updated.Status = domain.OrderStatusRejected
+	updated.StatusReason = "insufficient stock"
+	if err := repo.Update(ctx, updated); err != nil {
+		t.Fatalf("failed to update order: %v", err)
+	}
+	assertOrder(t, mustGet(t, repo, "order-1"), updated)
+
+	if err := repo.Create(ctx, newOrder("order-2")); err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+	other := newOrder("order-3")
+	other.CustomerID = "customer-2"
+	if err := repo.Create(ctx, other); err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+	orders, err := repo.List(ctx, "customer-1")
+	if err != nil {
+		t.Fatalf("failed to list orders: %v", err)
+	}
+	if len(orders) != 2 {
+		t.Fatalf("expected 2 orders of customer-1, got %d", len(orders))
+	}
+	orders, err = repo.List(ctx, "customer-2")
+	if err != nil {
+		t.Fatalf("failed to list orders: %v", err)
+	}
+	if len(orders) != 1 || orders[0].ID != "order-3" {
+		t.Fatalf("expected order-3 of customer-2, got %v", orders)
+	}
+
+	if err := repo.Delete(ctx, "order-1"); err != nil {
+		t.Fatalf("failed to delete order: %v", err)
+	}
+	if _, err := repo.Get(ctx, "order-1"); !errors.Is(err, order.ErrOrderNotFound) {
+		t.Fatalf("expected %v after delete, got %v", order.ErrOrderNotFound, err)
+	}
+}
+
+func testNotFound(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+
+	if _, err := repo.Get(ctx, "missing"); !errors.Is(err, order.ErrOrderNotFound) {
+		t.Errorf("Get: expected %v, got %v", order.ErrOrderNotFound, err)
+	}
+	if err := repo.Update(ctx, newOrder("missing")); !errors.Is(err, order.ErrOrderNotFound) {
+		t.Errorf("Update: expected %v, got %v", order.ErrOrderNotFound, err)
+	}
+	if err := repo.Delete(ctx, "missing"); !errors.Is(err, order.ErrOrderNotFound) {
+		t.Errorf("Delete: expected %v, got %v", order.ErrOrderNotFound, err)
+	}
+}
+
+func testAlreadyExists(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+
+	if err := repo.Create(ctx, newOrder("order-1")); err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+
+	duplicate := newOrder("order-1")
+	duplicate.CustomerID = "other"
+	if err := repo.Create(ctx, duplicate); !errors.Is(err, order.ErrOrderAlreadyExists) {
+		t.Fatalf("expected %v, got %v", order.ErrOrderAlreadyExists, err)
+	}
+
+	// The existing order is left unchanged.
+	assertOrder(t, mustGet(t, repo, "order-1"), newOrder("order-1"))
+}
+
+func testOutboxProcessed(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+	storeMessage(t, repo, "message-1", "topic")
+
+	claimed := mustClaim(t, repo, "worker", 10)
+	assertIDs(t, claimed, "message-1")
+	if claimed[0].Status != order.OutboxStatusPending || claimed[0].ClaimedBy != "worker" {
+		t.Fatalf("unexpected claimed message: %+v", claimed[0])
+	}
+
+	if err := repo.MarkOutboxMessageAsProcessed(ctx, "worker", "message-1"); err != nil {
+		t.Fatalf("failed to mark message as processed: %v", err)
+	}
+
+	assertIDs(t, mustClaim(t, repo, "worker", 10))
+	assertBacklog(t, repo, 0)
+}
+
+func testOutboxRetried(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+	storeMessage(t, repo, "message-1", "topic")
+	mustClaim(t, repo, "worker", 10)
+
+	nextAttemptAt := time.Now().Add(100 * time.Millisecond)
+	err := repo.MarkOutboxMessageAsRetried(ctx, "worker", "message-1", "queue unavailable", nextAttemptAt)
+	if err != nil {
+		t.Fatalf("failed to mark message as retried: %v", err)
+	}
+
+	// The message stays pending, but is not claimed before its next attempt.
+	assertIDs(t, mustClaim(t, repo, "worker", 10))
+	assertBacklog(t, repo, 1)
+
+	time.Sleep(time.Until(nextAttemptAt))
+	assertIDs(t, mustClaim(t, repo, "worker", 10), "message-1")
+	err = repo.MarkOutboxMessageAsRetried(ctx, "worker", "message-1", "queue still unavailable", time.Now())
+	if err != nil {
+		t.Fatalf("failed to mark message as retried: %v", err)
+	}
+
+	claimed := mustClaim(t, repo, "worker", 10)
+	assertIDs(t, claimed, "message-1")
+	if claimed[0].Attempts != 2 || claimed[0].LastError != "queue still unavailable" {
+		t.Fatalf("expected 2 attempts and the last error, got %d and %q", claimed[0].Attempts, claimed[0].LastError)
+	}
+}
+
+func testOutboxFailed(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+	storeMessage(t, repo, "message-1", "topic")
+	storeMessage(t, repo, "message-2", "topic")
+	mustClaim(t, repo, "worker", 1)
+
+	if err := repo.MarkOutboxMessageAsFailed(ctx, "worker", "message-1", "malformed"); err != nil {
+		t.Fatalf("failed to mark message as failed: %v", err)
+	}
+
+	// A failed message doesn't block its topic anymore.
+	assertIDs(t, mustClaim(t, repo, "worker", 10), "message-2")
+	assertBacklog(t, repo, 1)
+}
+
+func testOutboxMessageNotFound(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+
+	errs := map[string]error{
+		"MarkOutboxMessageAsProcessed": repo.MarkOutboxMessageAsProcessed(ctx, "worker", "missing"),
+		"MarkOutboxMessageAsRetried":   repo.MarkOutboxMessageAsRetried(ctx, "worker", "missing", "error", time.Now()),
+		"MarkOutboxMessageAsFailed":    repo.MarkOutboxMessageAsFailed(ctx, "worker", "missing", "error"),
+		"ReleaseOutboxMessage":         repo.ReleaseOutboxMessage(ctx, "worker", "missing"),
+	}
+	for method, err := range errs {
+		if !errors.Is(err, order.ErrOutboxMessageNotFound) {
+			t.Errorf("%s: expected %v, got %v", method, order.ErrOutboxMessageNotFound, err)
+		}
+	}
+}
+
+func testOutboxOrderPerTopic(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+	storeMessage(t, repo, "a-1", "a")
+	storeMessage(t, repo, "b-1", "b")
+	storeMessage(t, repo, "a-2", "a")
+	storeMessage(t, repo, "b-2", "b")
+
+	assertIDs(t, mustClaim(t, repo, "worker", 10), "a-1", "b-1", "a-2", "b-2")
+
+	// Retrying the oldest message of a topic blocks the rest of the topic, other topics go on.
+	err := repo.MarkOutboxMessageAsRetried(ctx, "worker", "a-1", "error", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to mark message as retried: %v", err)
+	}
+	for _, id := range []string{"b-1", "a-2", "b-2"} {
+		if err := repo.ReleaseOutboxMessage(ctx, "worker", id); err != nil {
+			t.Fatalf("failed to release message: %v", err)
+		}
+	}
+
+	assertIDs(t, mustClaim(t, repo, "worker", 10), "b-1", "b-2")
+}
+
+func testOutboxLease(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+	storeMessage(t, repo, "message-1", "topic")
+
+	if _, err := repo.ClaimOutboxMessages(ctx, "worker-1", 10, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("failed to claim messages: %v", err)
+	}
+	assertIDs(t, mustClaim(t, repo, "worker-2", 10))
+
+	if err := repo.ReleaseOutboxMessage(ctx, "worker-1", "message-1"); err != nil {
+		t.Fatalf("failed to release message: %v", err)
+	}
+
+	// An expired lease lets other workers claim the message.
+	claimed, err := repo.ClaimOutboxMessages(ctx, "worker-2", 10, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("failed to claim messages: %v", err)
+	}
+	assertIDs(t, claimed, "message-1")
+	assertIDs(t, mustClaim(t, repo, "worker-3", 10), "message-1")
+}
+
+func testOutboxLeaseLost(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+	storeMessage(t, repo, "message-1", "topic")
+
+	// worker-1 stalls until its lease expires and worker-2 claims the message.
+	if _, err := repo.ClaimOutboxMessages(ctx, "worker-1", 10, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("failed to claim messages: %v", err)
+	}
+	assertIDs(t, mustClaim(t, repo, "worker-2", 10), "message-1")
+
+	errs := map[string]error{
+		"MarkOutboxMessageAsProcessed": repo.MarkOutboxMessageAsProcessed(ctx, "worker-1", "message-1"),
+		"MarkOutboxMessageAsRetried":   repo.MarkOutboxMessageAsRetried(ctx, "worker-1", "message-1", "error", time.Now()),
+		"MarkOutboxMessageAsFailed":    repo.MarkOutboxMessageAsFailed(ctx, "worker-1", "message-1", "error"),
+		"ReleaseOutboxMessage":         repo.ReleaseOutboxMessage(ctx, "worker-1", "message-1"),
+	}
+	for method, err := range errs {
+		if !errors.Is(err, order.ErrOutboxLeaseLost) {
+			t.Errorf("%s: expected %v, got %v", method, order.ErrOutboxLeaseLost, err)
+		}
+	}
+
+	// The lease of worker-2 is untouched.
+	if err := repo.MarkOutboxMessageAsProcessed(ctx, "worker-2", "message-1"); err != nil {
+		t.Fatalf("failed to mark message as processed: %v", err)
+	}
+	assertBacklog(t, repo, 0)
+}
+
+func testOutboxPurge(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+	storeMessage(t, repo, "failed", "failing")
+	for i := 1; i < 3; i++ {
+		storeMessage(t, repo, fmt.Sprintf("processed-%d", i), "topic")
+	}
+	storeMessage(t, repo, "pending", "other")
+
+	mustClaim(t, repo, "worker", 10)
+	if err := repo.MarkOutboxMessageAsFailed(ctx, "worker", "failed", "broken"); err != nil {
+		t.Fatalf("failed to mark message as failed: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	for i := 1; i < 3; i++ {
+		if err := repo.MarkOutboxMessageAsProcessed(ctx, "worker", fmt.Sprintf("processed-%d", i)); err != nil {
+			t.Fatalf("failed to mark message as processed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := repo.ReleaseOutboxMessage(ctx, "worker", "pending"); err != nil {
+		t.Fatalf("failed to release message: %v", err)
+	}
+
+	purged, err := repo.PurgeOutboxMessages(ctx, time.Time{}, 0)
+	if err != nil || purged != 0 {
+		t.Fatalf("expected nothing purged without a retention, got %d, %v", purged, err)
+	}
+
+	purged, err = repo.PurgeOutboxMessages(ctx, time.Time{}, 1)
+	if err != nil || purged != 2 {
+		t.Fatalf("expected 2 messages purged keeping the last one, got %d, %v", purged, err)
+	}
+	err = repo.MarkOutboxMessageAsFailed(ctx, "worker", "failed", "broken")
+	if !errors.Is(err, order.ErrOutboxMessageNotFound) {
+		t.Fatalf("expected the failed message to be purged, got %v", err)
+	}
+
+	// The most recently processed message is kept, the pending message is never purged.
+	err = repo.MarkOutboxMessageAsProcessed(ctx, "worker", "processed-2")
+	if !errors.Is(err, order.ErrOutboxLeaseLost) {
+		t.Fatalf("expected the last processed message to be kept, got %v", err)
+	}
+
+	purged, err = repo.PurgeOutboxMessages(ctx, time.Now().Add(time.Second), 0)
+	if err != nil || purged != 1 {
+		t.Fatalf("expected 1 message purged by age, got %d, %v", purged, err)
+	}
+	assertBacklog(t, repo, 1)
+}
+
+func testOutboxSignal(t *testing.T, repo order.Repository) {
+	storeMessage(t, repo, "message-1", "topic")
+
+	select {
+	case <-repo.OutboxSignal():
+	case <-time.After(time.Second):
+		t.Fatal("expected a signal for the stored message")
+	}
+}
+
+func testTxCommit(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+
+	err := repo.WithinTx(ctx, func(tx order.Repository) error {
+		if err := tx.Create(ctx, newOrder("order-1")); err != nil {
+			return err
+		}
+
+		if err := tx.StoreOutboxMessage(ctx, newMessage("message-1", "topic")); err != nil {
+			return err
+		}
+
+		// The message is signaled on commit.
+		select {
+		case <-repo.OutboxSignal():
+			t.Error("unexpected signal before commit")
+		default:
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to commit transaction: %v", err)
+	}
+
+	select {
+	case <-repo.OutboxSignal():
+	case <-time.After(time.Second):
+		t.Fatal("expected a signal after commit")
+	}
+
+	mustGet(t, repo, "order-1")
+	assertIDs(t, mustClaim(t, repo, "worker", 10), "message-1")
+}
+
+func testTxRollback(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+	for _, id := range []string{"order-1", "order-3"} {
+		if err := repo.Create(ctx, newOrder(id)); err != nil {
+			t.Fatalf("failed to create order: %v", err)
+		}
+	}
+	if err := repo.StoreOutboxMessage(ctx, newMessage("message-0", "topic-0")); err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	<-repo.OutboxSignal()
+
+	errRollback := errors.New("rollback")
+	err := repo.WithinTx(ctx, func(tx order.Repository) error {
+		// Every change of the order is rolled back, not only the last one.
+		for _, status := range []domain.OrderStatus{domain.OrderStatusRejected, domain.OrderStatusCancelled} {
+			changed := newOrder("order-1")
+			changed.Status = status
+			if err := tx.Update(ctx, changed); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Create(ctx, newOrder("order-2")); err != nil {
+			return err
+		}
+
+		if err := tx.Delete(ctx, "order-3"); err != nil {
+			return err
+		}
+
+		if err := tx.StoreOutboxMessage(ctx, newMessage("message-1", "topic")); err != nil {
+			return err
+		}
+
+		if _, err := tx.ClaimOutboxMessages(ctx, "other-worker", 10, time.Now().Add(time.Hour)); err != nil {
+			return err
+		}
+
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("expected the error of the transaction, got %v", err)
+	}
+
+	assertOrder(t, mustGet(t, repo, "order-1"), newOrder("order-1"))
+	if _, err := repo.Get(ctx, "order-2"); !errors.Is(err, order.ErrOrderNotFound) {
+		t.Fatalf("expected the order created in the transaction to be rolled back, got %v", err)
+	}
+	assertOrder(t, mustGet(t, repo, "order-3"), newOrder("order-3"))
+	// The message stored before is not claimed anymore, the one stored in the transaction is gone.
+	assertIDs(t, mustClaim(t, repo, "worker", 10), "message-0")
+
+	select {
+	case <-repo.OutboxSignal():
+		t.Fatal("unexpected signal for a rolled back message")
+	default:
+	}
+}
+
+func testConcurrentCreate(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+
+	const count = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := repo.WithinTx(ctx, func(tx order.Repository) error {
+				if err := tx.Create(ctx, newOrder(fmt.Sprintf("order-%d", i))); err != nil {
+					return err
+				}
+
+				return tx.StoreOutboxMessage(ctx, newMessage(fmt.Sprintf("message-%d", i), "topic"))
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to create order: %v", err)
+		}
+	}
+
+	orders, err := repo.List(ctx, "customer-1")
+	if err != nil {
+		t.Fatalf("failed to list orders: %v", err)
+	}
+	if len(orders) != count {
+		t.Fatalf("expected %d orders, got %d", count, len(orders))
+	}
+	assertBacklog(t, repo, count)
+}
+
+func testConcurrentClaims(t *testing.T, repo order.Repository) {
+	ctx := context.Background()
+
+	const count = 50
+	for i := range count {
+		storeMessage(t, repo, fmt.Sprintf("message-%d", i), fmt.Sprintf("topic-%d", i))
+	}
+
+	var mu sync.Mutex
+	claimedBy := make(map[string]string)
+	var wg sync.WaitGroup
+	for worker := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			workerID := fmt.Sprintf("worker-%d", worker)
+			for {
+				claimed, err := repo.ClaimOutboxMessages(ctx, workerID, 3, time.Now().Add(time.Hour))
+				if err != nil {
+					t.Errorf("failed to claim messages: %v", err)
+					return
+				}
+				if len(claimed) == 0 {
+					return
+				}
+
+				mu.Lock()
+				for _, msg := range claimed {
+					if other, exists := claimedBy[msg.ID]; exists {
+						t.Errorf("message %s claimed by %s and %s", msg.ID, other, workerID)
+					}
+					claimedBy[msg.ID] = workerID
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimedBy) != count {
+		t.Fatalf("expected %d claimed messages, got %d", count, len(claimedBy))
+	}
+}
+
+func testOutboxBacklog(t *testing.T, repo order.Repository) {
+	assertBacklog(t, repo, 0)
+
+	before := time.Now()
+	storeMessage(t, repo, "message-1", "topic")
+	storeMessage(t, repo, "message-2", "topic")
+
+	backlog, err := repo.GetOutboxBacklog(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get backlog: %v", err)
+	}
+	if backlog.Pending != 2 {
+		t.Fatalf("expected 2 pending messages, got %d", backlog.Pending)
+	}
+	if backlog.OldestCreatedAt.Before(before) || backlog.OldestCreatedAt.After(time.Now()) {
+		t.Fatalf("unexpected creation time of the oldest message: %v", backlog.OldestCreatedAt)
+	}
+}
+
+func testOutboxRoundTrip(t *testing.T, repo order.Repository) {
+	message := newMessage("message-1", "topic")
+	message.Headers = map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	if err := repo.StoreOutboxMessage(context.Background(), message); err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+
+	claimed := mustClaim(t, repo, "worker", 10)
+	assertIDs(t, claimed, "message-1")
+	if string(claimed[0].Message) != string(message.Message) {
+		t.Errorf("expected message %s, got %s", message.Message, claimed[0].Message)
+	}
+	if claimed[0].Headers["traceparent"] != message.Headers["traceparent"] {
+		t.Errorf("expected headers %v, got %v", message.Headers, claimed[0].Headers)
+	}
+	if claimed[0].Topic != "topic" || claimed[0].CreatedAt.IsZero() {
+		t.Errorf("unexpected message: %+v", claimed[0])
+	}
+}
+
+func newOrder(id string) *domain.Order {
+	return &domain.Order{
+		ID:         id,
+		CustomerID: "customer-1",
+		ProductIDs: []string{"product-1", "product-1", "product-2"},
+		Status:     domain.OrderStatusPending,
+	}
+}
+
+func newMessage(id string, topic string) *order.OutboxMessage {
+	return &order.OutboxMessage{
+		ID:      id,
+		Topic:   topic,
+		Message: []byte(fmt.Sprintf(`{"id":%q}`, id)),
+	}
+}
+
+// storeMessage stores a message a moment after the previous one, so the messages are ordered by their
+// creation time.
+func storeMessage(t *testing.T, repo order.Repository, id string, topic string) {
+	t.Helper()
+
+	time.Sleep(time.Millisecond)
+	if err := repo.StoreOutboxMessage(context.Background(), newMessage(id, topic)); err != nil {
+		t.Fatalf("failed to store message %s: %v", id, err)
+	}
+}
+
+func mustGet(t *testing.T, repo order.Repository, id string) *domain.Order {
+	t.Helper()
+
+	got, err := repo.Get(context.Background(), id)
+	if err != nil {
+		t.Fatalf("failed to get order %s: %v", id, err)
+	}
+
+	return got
+}
+
+func mustClaim(t *testing.T, repo order.Repository, workerID string, limit int) []*order.OutboxMessage {
+	t.Helper()
+
+	claimed, err := repo.ClaimOutboxMessages(context.Background(), workerID, limit, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to claim messages: %v", err)
+	}
+
+	return claimed
+}
+
+func assertOrder(t *testing.T, got *domain.Order, want *domain.Order) {
+	t.Helper()
+
+	if got.ID != want.ID ||
+		got.CustomerID != want.CustomerID ||
+		fmt.Sprint(got.ProductIDs) != fmt.Sprint(want.ProductIDs) ||
+		got.Status != want.Status ||
+		got.StatusReason != want.StatusReason {
+		t.Fatalf("expected order %+v, got %+v", *want, *got)
+	}
+}
+
+func assertIDs(t *testing.T, messages []*order.OutboxMessage, ids ...string) {
+	t.Helper()
+
+	got := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		got = append(got, msg.ID)
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(ids) {
+		t.Fatalf("expected messages %v, got %v", ids, got)
+	}
+}
+
+func assertBacklog(t *testing.T, repo order.Repository, pending int) {
+	t.Helper()
+
+	backlog, err := repo.GetOutboxBacklog(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get backlog: %v", err)
+	}
+	if backlog.Pending != pending {
+		t.Fatalf("expected %d pending messages, got %d", pending, backlog.Pending)
+	}
+}
@@ -0,0 +1,60 @@
+package order
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// outboxMetrics describe the backlog of the outbox and how publishing it performs.
+type outboxMetrics struct {
+	pending          prometheus.Gauge
+	oldestPendingAge prometheus.Gauge
+	publishDuration  *prometheus.HistogramVec
+	publishFailures  *prometheus.CounterVec
+	purged           prometheus.Counter
+}
+
+func newOutboxMetrics(registerer prometheus.Registerer) *outboxMetrics {
+	return &outboxMetrics{
+		pending: register(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "outbox_pending_messages",
+			Help: "Number of outbox messages that are not published yet.",
+		})),
+		oldestPendingAge: register(registerer, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "outbox_oldest_pending_message_age_seconds",
+			Help: "Age of the oldest outbox message that is not published yet.",
+		})),
+		publishDuration: register(registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "outbox_publish_duration_seconds",
+			Help:    "Duration of publishing an outbox message to the queue.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"topic"})),
+		publishFailures: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "outbox_publish_failures_total",
+			Help: "Number of outbox messages that failed to be published.",
+		}, []string{"topic"})),
+		purged: register(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "outbox_purged_messages_total",
+			Help: "Number of processed and failed outbox messages deleted by the retention policy.",
+		})),
+	}
+}
+
+// register registers the collector or returns the one registered before under the same name, so that
+// several workers can share the registry.
+func register[T prometheus.Collector](registerer prometheus.Registerer, collector T) T {
+	err := registerer.Register(collector)
+
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		if existing, ok := alreadyRegistered.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return collector
+}
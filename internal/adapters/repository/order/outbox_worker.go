@@ -3,24 +3,142 @@ package order
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"go-microservices-observability/internal/adapters/queue"
+	"go-microservices-observability/pkg/tracing"
 	"log"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// OutboxWorkerConfig configures an OutboxWorker.
+type OutboxWorkerConfig struct {
+	// Interval is the time between two sweeps of the outbox. Messages are published as soon as the
+	// repository signals them, the sweep picks up retries and messages of other workers with an expired
+	// lease. Defaults to 5 seconds.
+	Interval time.Duration
+	// BatchSize is the maximum number of messages claimed at once. Defaults to 100.
+	BatchSize int
+	// Tracer creates a span per batch, linked to the spans the messages were stored in.
+	Tracer tracing.Tracer
+	// Registerer registers the outbox metrics. Defaults to prometheus.DefaultRegisterer, which is served
+	// by the diagnostics server.
+	Registerer prometheus.Registerer
+	// RetryPolicy defines when a message is published again after a failure and when it is given up.
+	// Unset fields default to the ones of DefaultOutboxRetryPolicy.
+	RetryPolicy queue.RetryPolicy
+	// Retention defines which processed and failed messages are deleted. Defaults to DefaultOutboxRetention.
+	Retention OutboxRetention
+	// ID identifies the worker among the workers sharing the outbox. Defaults to a random ID.
+	ID string
+	// LeaseDuration is the time a worker has to publish the messages it claimed before other workers may
+	// claim them, e.g. after a crash. Defaults to 30 seconds.
+	LeaseDuration time.Duration
+}
+
+const (
+	defaultOutboxInterval      = 5 * time.Second
+	defaultOutboxBatchSize     = 100
+	defaultOutboxLeaseDuration = 30 * time.Second
 )
 
+// OutboxRetention defines how long processed and failed messages are kept.
+type OutboxRetention struct {
+	// MaxAge deletes the messages processed longer ago. Zero keeps them regardless of their age.
+	MaxAge time.Duration
+	// KeepLast deletes all but the given number of most recently processed messages. Zero keeps them
+	// regardless of their number.
+	KeepLast int
+	// Interval is the time between two compactions. Defaults to the interval of DefaultOutboxRetention.
+	Interval time.Duration
+}
+
+// DefaultOutboxRetention keeps processed and failed messages for an hour.
+var DefaultOutboxRetention = OutboxRetention{
+	MaxAge:   1 * time.Hour,
+	Interval: 1 * time.Minute,
+}
+
+// DefaultOutboxRetryPolicy makes ten attempts to publish a message over about eight minutes.
+var DefaultOutboxRetryPolicy = queue.RetryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     10 * time.Minute,
+	Multiplier:     2,
+}
+
+// errMalformedMessage fails a message without further attempts.
+var errMalformedMessage = errors.New("malformed outbox message")
+
 type OutboxWorker struct {
-	repository Repository
-	queue      queue.Queue
-	interval   time.Duration
-	done       chan struct{}
+	id            string
+	leaseDuration time.Duration
+	repository    Repository
+	queue         queue.Queue
+	interval      time.Duration
+	batchSize     int
+	retryPolicy   queue.RetryPolicy
+	retention     OutboxRetention
+	tracer        tracing.Tracer
+	metrics       *outboxMetrics
+	done          chan struct{}
+	stopped       chan struct{}
 }
 
-func NewOutboxWorker(repository Repository, queue queue.Queue, interval time.Duration) *OutboxWorker {
+func NewOutboxWorker(repository Repository, queue queue.Queue, config *OutboxWorkerConfig) *OutboxWorker {
+	registerer := config.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	retryPolicy := config.RetryPolicy.WithDefaults(DefaultOutboxRetryPolicy)
+
+	retention := config.Retention
+	if retention == (OutboxRetention{}) {
+		retention = DefaultOutboxRetention
+	}
+	if retention.Interval <= 0 {
+		retention.Interval = DefaultOutboxRetention.Interval
+	}
+
+	id := config.ID
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	interval := config.Interval
+	if interval <= 0 {
+		interval = defaultOutboxInterval
+	}
+
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultOutboxBatchSize
+	}
+
+	leaseDuration := config.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = defaultOutboxLeaseDuration
+	}
+
 	return &OutboxWorker{
-		repository: repository,
-		queue:      queue,
-		interval:   interval,
-		done:       make(chan struct{}),
+		id:            id,
+		leaseDuration: leaseDuration,
+		repository:    repository,
+		queue:         queue,
+		interval:      interval,
+		batchSize:     batchSize,
+		retryPolicy:   retryPolicy,
+		retention:     retention,
+		tracer:        config.Tracer,
+		metrics:       newOutboxMetrics(registerer),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
 	}
 }
 
@@ -28,57 +146,218 @@ func (w *OutboxWorker) Start() {
 	go w.processOutbox()
 }
 
-func (w *OutboxWorker) Stop() {
+// Stop stops the worker after publishing the pending messages one last time. It returns ctx.Err() if
+// ctx is done before the worker finished.
+func (w *OutboxWorker) Stop(ctx context.Context) error {
 	close(w.done)
+
+	select {
+	case <-w.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (w *OutboxWorker) processOutbox() {
+	defer close(w.stopped)
+
 	ticker := time.NewTicker(w.interval)
 	defer ticker.Stop()
 
+	compactionTicker := time.NewTicker(w.retention.Interval)
+	defer compactionTicker.Stop()
+
+	ctx := context.Background()
+
 	for {
 		select {
 		case <-w.done:
+			// Flush the messages stored since the last tick, so they are not delayed until the next start.
+			if err := w.processMessages(ctx); err != nil {
+				log.Printf("Error processing outbox messages: %v", err)
+			}
 			return
+		case <-w.repository.OutboxSignal():
+			if err := w.processMessages(ctx); err != nil {
+				log.Printf("Error processing outbox messages: %v", err)
+			}
 		case <-ticker.C:
-			if err := w.processMessages(); err != nil {
+			if err := w.processMessages(ctx); err != nil {
 				log.Printf("Error processing outbox messages: %v", err)
 			}
+		case <-compactionTicker.C:
+			if _, err := w.Compact(ctx); err != nil {
+				log.Printf("Error compacting outbox: %v", err)
+			}
 		}
 	}
 }
 
-func (w *OutboxWorker) processMessages() error {
-	ctx := context.Background()
-	messages, err := w.repository.GetPendingOutboxMessages(ctx)
+// Compact deletes the processed and failed messages according to the retention policy and returns their number.
+func (w *OutboxWorker) Compact(ctx context.Context) (int, error) {
+	ctx, span := w.tracer.Start(ctx, "internal.adapters.repository.order.OutboxWorker.Compact")
+	defer span.End()
+
+	var processedBefore time.Time
+	if w.retention.MaxAge > 0 {
+		processedBefore = time.Now().Add(-w.retention.MaxAge)
+	}
+
+	purged, err := w.repository.PurgeOutboxMessages(ctx, processedBefore, w.retention.KeepLast)
 	if err != nil {
-		return err
+		span.RecordError(err)
+		return 0, err
 	}
 
+	w.metrics.purged.Add(float64(purged))
+	span.SetAttributes(attribute.Int("outbox.purged", purged))
+
+	return purged, nil
+}
+
+// processMessages publishes batches of messages until a batch is not full anymore.
+func (w *OutboxWorker) processMessages(ctx context.Context) error {
+	w.observeBacklog(ctx)
+
+	for {
+		claimed, err := w.processBatch(ctx)
+		if err != nil {
+			return err
+		}
+
+		if claimed < w.batchSize {
+			return nil
+		}
+	}
+}
+
+// processBatch claims a batch of messages and publishes them. It returns the number of claimed messages.
+func (w *OutboxWorker) processBatch(ctx context.Context) (int, error) {
+	messages, err := w.repository.ClaimOutboxMessages(ctx, w.id, w.batchSize, time.Now().Add(w.leaseDuration))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	// The batch starts a trace of its own, linked to the requests that stored its messages.
+	links := make([]oteltrace.Link, 0, len(messages))
 	for _, msg := range messages {
-		// Create a map to hold the raw JSON message
-		var rawMessage map[string]interface{}
-		if err := json.Unmarshal(msg.Message, &rawMessage); err != nil {
-			log.Printf("Error unmarshaling message %s: %v", msg.ID, err)
-			continue
+		spanContext := oteltrace.SpanContextFromContext(tracing.ExtractMessage(ctx, msg.Headers))
+		if spanContext.IsValid() {
+			links = append(links, oteltrace.Link{SpanContext: spanContext})
 		}
+	}
 
-		// Re-marshal the message to ensure it's properly formatted JSON
-		messageBytes, err := json.Marshal(rawMessage)
-		if err != nil {
-			log.Printf("Error re-marshaling message %s: %v", msg.ID, err)
+	ctx, span := w.tracer.Start(
+		ctx,
+		"internal.adapters.repository.order.OutboxWorker.ProcessBatch",
+		oteltrace.WithNewRoot(),
+		oteltrace.WithLinks(links...),
+		oteltrace.WithAttributes(attribute.String("outbox.worker.id", w.id)),
+	)
+	defer span.End()
+
+	// Messages are published in order per topic, so the rest of a topic waits for the retry of a message.
+	blocked := make(map[string]bool)
+	failed := 0
+	for _, msg := range messages {
+		if blocked[msg.Topic] {
+			if err := w.repository.ReleaseOutboxMessage(ctx, w.id, msg.ID); err != nil {
+				log.Printf("Error releasing message %s: %v", msg.ID, err)
+			}
 			continue
 		}
 
-		if err := w.queue.Publish(msg.Topic, messageBytes); err != nil {
-			log.Printf("Error publishing message %s: %v", msg.ID, err)
+		err := w.publish(ctx, msg)
+		if err == nil {
 			continue
 		}
 
-		if err := w.repository.MarkOutboxMessageAsProcessed(ctx, msg.ID); err != nil {
-			log.Printf("Error marking message %s as processed: %v", msg.ID, err)
+		log.Printf("Error publishing message %s: %v", msg.ID, err)
+		w.metrics.publishFailures.WithLabelValues(msg.Topic).Inc()
+		failed++
+		if w.recordFailure(ctx, msg, err) {
+			blocked[msg.Topic] = true
 		}
 	}
 
+	w.observeBacklog(ctx)
+	span.SetAttributes(
+		attribute.Int("outbox.batch.size", len(messages)),
+		attribute.Int("outbox.batch.failed", failed),
+	)
+
+	return len(messages), nil
+}
+
+// publish publishes a single outbox message and marks it as processed.
+func (w *OutboxWorker) publish(ctx context.Context, msg *OutboxMessage) error {
+	// Create a map to hold the raw JSON message
+	var rawMessage map[string]interface{}
+	if err := json.Unmarshal(msg.Message, &rawMessage); err != nil {
+		return fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+
+	// Re-marshal the message to ensure it's properly formatted JSON
+	messageBytes, err := json.Marshal(rawMessage)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+
+	// Publish within the trace of the request that stored the message.
+	publishCtx := tracing.ExtractMessage(ctx, msg.Headers)
+	start := time.Now()
+	err = w.queue.Publish(publishCtx, msg.Topic, messageBytes)
+	w.metrics.publishDuration.WithLabelValues(msg.Topic).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+
+	if err := w.repository.MarkOutboxMessageAsProcessed(ctx, w.id, msg.ID); err != nil {
+		// The message is published again, consumers have to cope with duplicates anyway.
+		log.Printf("Error marking message %s as processed: %v", msg.ID, err)
+	}
+
 	return nil
 }
+
+// recordFailure schedules the next attempt of a message with exponential backoff or marks it as failed
+// after the maximum number of attempts. It reports whether the message is retried.
+func (w *OutboxWorker) recordFailure(ctx context.Context, msg *OutboxMessage, publishErr error) bool {
+	attempts := msg.Attempts + 1
+	if errors.Is(publishErr, errMalformedMessage) || attempts >= w.retryPolicy.MaxAttempts {
+		if err := w.repository.MarkOutboxMessageAsFailed(ctx, w.id, msg.ID, publishErr.Error()); err != nil {
+			log.Printf("Error marking message %s as failed: %v", msg.ID, err)
+		}
+		log.Printf("Giving up message %s after %d attempts", msg.ID, attempts)
+
+		return false
+	}
+
+	nextAttemptAt := time.Now().Add(w.retryPolicy.Backoff(attempts + 1))
+	if err := w.repository.MarkOutboxMessageAsRetried(ctx, w.id, msg.ID, publishErr.Error(), nextAttemptAt); err != nil {
+		log.Printf("Error scheduling retry of message %s: %v", msg.ID, err)
+	}
+
+	return true
+}
+
+// observeBacklog updates the backlog metrics.
+func (w *OutboxWorker) observeBacklog(ctx context.Context) {
+	backlog, err := w.repository.GetOutboxBacklog(ctx)
+	if err != nil {
+		log.Printf("Error getting outbox backlog: %v", err)
+		return
+	}
+
+	w.metrics.pending.Set(float64(backlog.Pending))
+	if backlog.OldestCreatedAt.IsZero() {
+		w.metrics.oldestPendingAge.Set(0)
+		return
+	}
+	w.metrics.oldestPendingAge.Set(time.Since(backlog.OldestCreatedAt).Seconds())
+}
@@ -0,0 +1,330 @@
+package order_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go-microservices-observability/internal/adapters/queue"
+	"go-microservices-observability/internal/adapters/repository/order"
+	"go-microservices-observability/pkg/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestOutboxWorker_Compact(t *testing.T) {
+	ctx := context.Background()
+	repo := order.NewRepository()
+
+	for _, id := range []string{"failed", "processed-1", "processed-2"} {
+		time.Sleep(time.Millisecond)
+		err := repo.StoreOutboxMessage(ctx, &order.OutboxMessage{ID: id, Topic: id, Message: []byte(`{}`)})
+		if err != nil {
+			t.Fatalf("failed to store message %s: %v", id, err)
+		}
+	}
+	if _, err := repo.ClaimOutboxMessages(ctx, "worker", 10, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("failed to claim messages: %v", err)
+	}
+	if err := repo.MarkOutboxMessageAsFailed(ctx, "worker", "failed", "broken"); err != nil {
+		t.Fatalf("failed to mark message as failed: %v", err)
+	}
+	for _, id := range []string{"processed-1", "processed-2"} {
+		time.Sleep(time.Millisecond)
+		if err := repo.MarkOutboxMessageAsProcessed(ctx, "worker", id); err != nil {
+			t.Fatalf("failed to mark message as processed: %v", err)
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	worker := order.NewOutboxWorker(repo, queue.NewInMemoryQueue(nil), &order.OutboxWorkerConfig{
+		Tracer:     tracing.NewTracer("test", tracetest.NewInMemoryExporter()),
+		Registerer: registry,
+		// Without an interval only the interval is defaulted, the retention keeps its rules.
+		Retention: order.OutboxRetention{KeepLast: 1},
+	})
+
+	purged, err := worker.Compact(ctx)
+	if err != nil || purged != 2 {
+		t.Fatalf("expected 2 messages purged keeping the last one, got %d, %v", purged, err)
+	}
+	if got := metricValue(t, registry, "outbox_purged_messages_total"); got != 2 {
+		t.Fatalf("expected 2 purged messages in the metric, got %v", got)
+	}
+
+	purged, err = worker.Compact(ctx)
+	if err != nil || purged != 0 {
+		t.Fatalf("expected nothing purged after compacting, got %d, %v", purged, err)
+	}
+	if got := metricValue(t, registry, "outbox_purged_messages_total"); got != 2 {
+		t.Fatalf("expected 2 purged messages in the metric, got %v", got)
+	}
+}
+
+func TestOutboxWorker_PublishesStoredMessageRightAway(t *testing.T) {
+	ctx := context.Background()
+	repo := order.NewRepository()
+
+	published := make(chan string, 1)
+	worker := order.NewOutboxWorker(repo, funcQueue{publish: func(topic string) error {
+		published <- topic
+		return nil
+	}}, &order.OutboxWorkerConfig{
+		Tracer:     tracing.NewTracer("test", tracetest.NewInMemoryExporter()),
+		Registerer: prometheus.NewRegistry(),
+		// The sweep doesn't come around during the test, only the signal of the repository does.
+		Interval: time.Hour,
+	})
+	worker.Start()
+	t.Cleanup(func() { _ = worker.Stop(ctx) })
+
+	storeMessage(t, repo, "m1")
+
+	select {
+	case topic := <-published:
+		if topic != "orders" {
+			t.Fatalf("expected the message to be published to orders, got %s", topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stored message was not published before the next sweep")
+	}
+}
+
+func TestOutboxWorker_RetriesWithBackoffAndFails(t *testing.T) {
+	ctx := context.Background()
+	repo := &recordingRepository{Repository: order.NewRepository()}
+
+	var mu sync.Mutex
+	var attempts []time.Time
+	registry := prometheus.NewRegistry()
+	retryPolicy := queue.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	worker := order.NewOutboxWorker(repo, funcQueue{publish: func(string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, time.Now())
+		return errors.New("queue unavailable")
+	}}, &order.OutboxWorkerConfig{
+		Tracer:      tracing.NewTracer("test", tracetest.NewInMemoryExporter()),
+		Registerer:  registry,
+		Interval:    5 * time.Millisecond,
+		RetryPolicy: retryPolicy,
+	})
+	worker.Start()
+
+	storeMessage(t, repo, "m1")
+
+	waitFor(t, func() bool { return repo.marked("m1") == order.OutboxStatusFailed })
+	// Sweep a few more times, the failed message is not published anymore.
+	time.Sleep(50 * time.Millisecond)
+	if err := worker.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop worker: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != retryPolicy.MaxAttempts {
+		t.Fatalf("expected %d attempts, got %d", retryPolicy.MaxAttempts, len(attempts))
+	}
+	for i := 1; i < len(attempts); i++ {
+		if delay := attempts[i].Sub(attempts[i-1]); delay < retryPolicy.Backoff(i+1) {
+			t.Errorf("attempt %d came after %v, want at least %v", i+1, delay, retryPolicy.Backoff(i+1))
+		}
+	}
+
+	backlog, err := repo.GetOutboxBacklog(ctx)
+	if err != nil || backlog.Pending != 0 {
+		t.Fatalf("expected no pending messages, got %+v, %v", backlog, err)
+	}
+
+	if got := metricValue(t, registry, "outbox_publish_failures_total"); got != 3 {
+		t.Errorf("expected 3 publish failures in the metric, got %v", got)
+	}
+	if got := metricValue(t, registry, "outbox_publish_duration_seconds"); got != 3 {
+		t.Errorf("expected 3 observed publish durations, got %v", got)
+	}
+	if got := metricValue(t, registry, "outbox_pending_messages"); got != 0 {
+		t.Errorf("expected no pending messages in the metric, got %v", got)
+	}
+}
+
+func TestOutboxWorker_ReclaimsExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	repo := &recordingRepository{Repository: order.NewRepository()}
+
+	// The first worker hangs in publishing the message until its lease expired.
+	publishing := make(chan struct{})
+	unblock := make(chan struct{})
+	hanging := order.NewOutboxWorker(repo, funcQueue{publish: func(string) error {
+		close(publishing)
+		<-unblock
+		return nil
+	}}, &order.OutboxWorkerConfig{
+		ID:            "worker-a",
+		Tracer:        tracing.NewTracer("test", tracetest.NewInMemoryExporter()),
+		Registerer:    prometheus.NewRegistry(),
+		Interval:      time.Hour,
+		LeaseDuration: 50 * time.Millisecond,
+	})
+	hanging.Start()
+
+	storeMessage(t, repo, "m1")
+	<-publishing
+
+	published := make(chan struct{})
+	worker := order.NewOutboxWorker(repo, funcQueue{publish: func(string) error {
+		close(published)
+		return nil
+	}}, &order.OutboxWorkerConfig{
+		ID:         "worker-b",
+		Tracer:     tracing.NewTracer("test", tracetest.NewInMemoryExporter()),
+		Registerer: prometheus.NewRegistry(),
+		Interval:   10 * time.Millisecond,
+	})
+	worker.Start()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message of the hanging worker was not claimed again after its lease expired")
+	}
+	waitFor(t, func() bool { return repo.marked("m1") == order.OutboxStatusProcessed })
+
+	// The hanging worker publishes as well, but can't record the outcome of a message it lost.
+	close(unblock)
+	if err := hanging.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop worker: %v", err)
+	}
+	if err := worker.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop worker: %v", err)
+	}
+	if err := repo.markErr("worker-a"); !errors.Is(err, order.ErrOutboxLeaseLost) {
+		t.Fatalf("expected %v for the hanging worker, got %v", order.ErrOutboxLeaseLost, err)
+	}
+	if err := repo.markErr("worker-b"); err != nil {
+		t.Fatalf("expected the message to be processed by the second worker, got %v", err)
+	}
+}
+
+// funcQueue publishes with a function of the topic.
+type funcQueue struct {
+	queue.Queue
+
+	publish func(topic string) error
+}
+
+func (q funcQueue) Publish(ctx context.Context, topic string, message interface{}) error {
+	return q.publish(topic)
+}
+
+// recordingRepository records the outcome the workers mark the messages with.
+type recordingRepository struct {
+	order.Repository
+
+	mu sync.Mutex
+	// statuses holds the last status per message, errs the result of the last mark per worker.
+	statuses map[string]string
+	errs     map[string]error
+}
+
+func (r *recordingRepository) MarkOutboxMessageAsProcessed(ctx context.Context, workerID string, id string) error {
+	err := r.Repository.MarkOutboxMessageAsProcessed(ctx, workerID, id)
+	r.record(workerID, id, order.OutboxStatusProcessed, err)
+
+	return err
+}
+
+func (r *recordingRepository) MarkOutboxMessageAsFailed(
+	ctx context.Context,
+	workerID string,
+	id string,
+	lastError string,
+) error {
+	err := r.Repository.MarkOutboxMessageAsFailed(ctx, workerID, id, lastError)
+	r.record(workerID, id, order.OutboxStatusFailed, err)
+
+	return err
+}
+
+func (r *recordingRepository) record(workerID string, id string, status string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.statuses == nil {
+		r.statuses = make(map[string]string)
+		r.errs = make(map[string]error)
+	}
+	if err == nil {
+		r.statuses[id] = status
+	}
+	r.errs[workerID] = err
+}
+
+func (r *recordingRepository) marked(id string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.statuses[id]
+}
+
+func (r *recordingRepository) markErr(workerID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.errs[workerID]
+}
+
+func storeMessage(t *testing.T, repo order.Repository, id string) {
+	t.Helper()
+
+	msg := &order.OutboxMessage{ID: id, Topic: "orders", Message: []byte(`{}`)}
+	if err := repo.StoreOutboxMessage(context.Background(), msg); err != nil {
+		t.Fatalf("failed to store message %s: %v", id, err)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// metricValue returns the sum of the values of a counter or gauge, or the number of observations of a
+// histogram, over all its labels.
+func metricValue(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		var value float64
+		for _, metric := range family.GetMetric() {
+			value += metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+			value += float64(metric.GetHistogram().GetSampleCount())
+		}
+		return value
+	}
+
+	t.Fatalf("%s is not registered", name)
+	return 0
+}
@@ -2,36 +2,115 @@ package order
 
 import (
 	"context"
-	"errors"
 	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
+	"sort"
 	"sync"
 	"time"
 )
 
-var ErrOrderNotFound = errors.New("order not found")
-var ErrOrderAlreadyExists = errors.New("order already exists")
+var ErrOrderNotFound = errs.New(errs.ErrNotFound, "order not found")
+var ErrOrderAlreadyExists = errs.New(errs.ErrAlreadyExists, "order already exists")
+var ErrOutboxMessageNotFound = errs.New(errs.ErrNotFound, "outbox message not found")
+
+// ErrOutboxLeaseLost is returned when a worker updates a message it doesn't hold the lease of anymore, e.g.
+// because the lease expired and another worker claimed the message.
+var ErrOutboxLeaseLost = errs.New(errs.ErrConflict, "outbox message lease lost")
+
+const (
+	OutboxStatusPending   = "pending"
+	OutboxStatusProcessed = "processed"
+	// OutboxStatusFailed is final, the message is not published anymore.
+	OutboxStatusFailed = "failed"
+)
 
 type OutboxMessage struct {
-	ID        string
-	Topic     string
-	Message   []byte
+	ID      string
+	Topic   string
+	Message []byte
+	// Headers hold the trace context of the request that stored the message.
+	Headers   map[string]string
 	CreatedAt time.Time
 	Status    string
+	// Attempts is the number of failed attempts to publish the message.
+	Attempts  int
+	LastError string
+	// NextAttemptAt is the earliest time the message is published again after a failed attempt.
+	NextAttemptAt time.Time
+	// ProcessedAt is the time the message was published or given up.
+	ProcessedAt time.Time
+	// ClaimedBy is the worker that holds the lease of the message until LeaseUntil.
+	ClaimedBy  string
+	LeaseUntil time.Time
+}
+
+// OutboxBacklog describes the messages that are not published yet.
+type OutboxBacklog struct {
+	Pending         int
+	OldestCreatedAt time.Time
 }
 
 type Repository interface {
-	List(ctx context.Context) ([]*domain.Order, error)
+	// List returns the orders of a customer.
+	List(ctx context.Context, customerID string) ([]*domain.Order, error)
 	Get(ctx context.Context, id string) (*domain.Order, error)
 	Create(ctx context.Context, order *domain.Order) error
 	Update(ctx context.Context, order *domain.Order) error
 	Delete(ctx context.Context, id string) error
+	// StoreOutboxMessage stores a pending message and signals OutboxSignal, within a transaction once it
+	// is committed.
 	StoreOutboxMessage(ctx context.Context, message *OutboxMessage) error
-	GetPendingOutboxMessages(ctx context.Context) ([]*OutboxMessage, error)
-	MarkOutboxMessageAsProcessed(ctx context.Context, id string) error
+	// OutboxSignal receives a value after messages were stored, so a worker can publish them right away.
+	// Signals of several stores are coalesced while nobody receives them.
+	OutboxSignal() <-chan struct{}
+	// ClaimOutboxMessages leases up to limit pending messages that are due to workerID until leaseUntil,
+	// so that no other worker publishes them meanwhile. Messages whose lease expired are claimed again.
+	// The messages are returned ordered by CreatedAt. A topic is skipped from its first message that is
+	// not due or leased by another worker on, so the messages of a topic are published in order.
+	ClaimOutboxMessages(ctx context.Context, workerID string, limit int, leaseUntil time.Time) ([]*OutboxMessage, error)
+	// ReleaseOutboxMessage gives up the lease of a message without an attempt.
+	ReleaseOutboxMessage(ctx context.Context, workerID string, id string) error
+	// GetOutboxBacklog returns the number of pending messages and the age of the oldest one.
+	GetOutboxBacklog(ctx context.Context) (OutboxBacklog, error)
+	// MarkOutboxMessageAsProcessed, MarkOutboxMessageAsRetried and MarkOutboxMessageAsFailed release the
+	// lease of a message claimed by workerID after an attempt. They return ErrOutboxLeaseLost if the
+	// message is not claimed by workerID anymore.
+	MarkOutboxMessageAsProcessed(ctx context.Context, workerID string, id string) error
+	// MarkOutboxMessageAsRetried records a failed attempt and schedules the next one.
+	MarkOutboxMessageAsRetried(
+		ctx context.Context,
+		workerID string,
+		id string,
+		lastError string,
+		nextAttemptAt time.Time,
+	) error
+	// MarkOutboxMessageAsFailed records a failed attempt after which the message is given up.
+	MarkOutboxMessageAsFailed(ctx context.Context, workerID string, id string, lastError string) error
+	// PurgeOutboxMessages deletes the processed and failed messages that were processed before
+	// processedBefore or that are not among the keepLast most recently processed ones. A zero
+	// processedBefore or keepLast disables the respective rule. It returns the number of deleted messages.
+	PurgeOutboxMessages(ctx context.Context, processedBefore time.Time, keepLast int) (int, error)
+	// WithinTx runs fn in a transaction. The changes made through tx are committed together if fn
+	// returns nil and rolled back otherwise. Calling WithinTx on tx joins the running transaction.
+	WithinTx(ctx context.Context, fn func(tx Repository) error) error
 }
 
 type repository struct {
-	mu     sync.RWMutex
+	mu     *sync.RWMutex
+	orders map[string]*domain.Order
+	outbox map[string]*OutboxMessage
+	signal chan struct{}
+	// inTx is set on the repository passed to a transaction, which already holds mu. stored records
+	// whether the transaction stored outbox messages, which are signaled on commit.
+	inTx   bool
+	stored bool
+	// undo records the values a transaction replaced, so they can be restored on rollback.
+	undo *undoLog
+}
+
+// undoLog holds the values of the orders and outbox messages before a transaction first changed them, nil
+// for the ones that didn't exist.
+type undoLog struct {
 	orders map[string]*domain.Order
 	outbox map[string]*OutboxMessage
 }
@@ -39,64 +118,329 @@ type repository struct {
 // NewRepository creates a new order repository.
 func NewRepository() Repository {
 	return &repository{
+		mu:     &sync.RWMutex{},
 		orders: make(map[string]*domain.Order),
 		outbox: make(map[string]*OutboxMessage),
+		signal: make(chan struct{}, 1),
 	}
 }
 
-func (r *repository) StoreOutboxMessage(ctx context.Context, message *OutboxMessage) error {
+// WithinTx runs fn on the repository while holding the lock, so other callers neither see nor interfere
+// with the transaction. The changes are written through and the replaced values are restored on rollback,
+// so a transaction only costs the rows it touches.
+func (r *repository) WithinTx(ctx context.Context, fn func(tx Repository) error) error {
+	if r.inTx {
+		return fn(r)
+	}
+
+	defer r.lock()()
+
+	tx := &repository{
+		mu:     r.mu,
+		orders: r.orders,
+		outbox: r.outbox,
+		signal: r.signal,
+		inTx:   true,
+		undo: &undoLog{
+			orders: make(map[string]*domain.Order),
+			outbox: make(map[string]*OutboxMessage),
+		},
+	}
+
+	// Also rolled back if fn panics, so the repository isn't left with half a transaction.
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+
+	if tx.stored {
+		r.notify()
+	}
+
+	return nil
+}
+
+// rollback restores the values the transaction replaced.
+func (r *repository) rollback() {
+	for id, order := range r.undo.orders {
+		if order == nil {
+			delete(r.orders, id)
+		} else {
+			r.orders[id] = order
+		}
+	}
+
+	for id, msg := range r.undo.outbox {
+		if msg == nil {
+			delete(r.outbox, id)
+		} else {
+			r.outbox[id] = msg
+		}
+	}
+}
+
+// setOrder stores an order, or deletes it if order is nil. Within a transaction the replaced order is
+// recorded first. It must be called with the lock held.
+func (r *repository) setOrder(id string, order *domain.Order) {
+	if r.undo != nil {
+		if _, recorded := r.undo.orders[id]; !recorded {
+			r.undo.orders[id] = r.orders[id]
+		}
+	}
+
+	if order == nil {
+		delete(r.orders, id)
+	} else {
+		r.orders[id] = order
+	}
+}
+
+// setOutboxMessage is like setOrder for outbox messages. Stored messages are replaced rather than changed,
+// so the recorded message stays intact.
+func (r *repository) setOutboxMessage(id string, msg *OutboxMessage) {
+	if r.undo != nil {
+		if _, recorded := r.undo.outbox[id]; !recorded {
+			r.undo.outbox[id] = r.outbox[id]
+		}
+	}
+
+	if msg == nil {
+		delete(r.outbox, id)
+	} else {
+		r.outbox[id] = msg
+	}
+}
+
+// lock locks the repository for writing unless it is used within a transaction and returns the unlock
+// function.
+func (r *repository) lock() func() {
+	if r.inTx {
+		return func() {}
+	}
+
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	return r.mu.Unlock
+}
+
+// rlock is like lock for reading.
+func (r *repository) rlock() func() {
+	if r.inTx {
+		return func() {}
+	}
+
+	r.mu.RLock()
+	return r.mu.RUnlock
+}
+
+func (r *repository) StoreOutboxMessage(ctx context.Context, message *OutboxMessage) error {
+	defer r.lock()()
 
 	message.CreatedAt = time.Now()
-	message.Status = "pending"
-	r.outbox[message.ID] = message
+	message.Status = OutboxStatusPending
+	r.setOutboxMessage(message.ID, message)
+
+	if r.inTx {
+		r.stored = true
+	} else {
+		r.notify()
+	}
 
 	return nil
 }
 
-func (r *repository) GetPendingOutboxMessages(ctx context.Context) ([]*OutboxMessage, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+func (r *repository) OutboxSignal() <-chan struct{} {
+	return r.signal
+}
+
+// notify signals stored outbox messages without blocking, a pending signal already covers them.
+func (r *repository) notify() {
+	select {
+	case r.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (r *repository) ClaimOutboxMessages(
+	ctx context.Context,
+	workerID string,
+	limit int,
+	leaseUntil time.Time,
+) ([]*OutboxMessage, error) {
+	defer r.lock()()
+
+	now := time.Now()
+	blocked := make(map[string]bool)
+	var claimed []*OutboxMessage
+	for _, msg := range r.pendingOutboxMessages() {
+		if len(claimed) >= limit {
+			break
+		}
+		if blocked[msg.Topic] {
+			continue
+		}
+
+		leased := msg.ClaimedBy != "" && msg.LeaseUntil.After(now)
+		if leased || msg.NextAttemptAt.After(now) {
+			blocked[msg.Topic] = true
+			continue
+		}
 
+		updated := *msg
+		updated.ClaimedBy = workerID
+		updated.LeaseUntil = leaseUntil
+		r.setOutboxMessage(msg.ID, &updated)
+		claimed = append(claimed, &updated)
+	}
+
+	return claimed, nil
+}
+
+func (r *repository) ReleaseOutboxMessage(ctx context.Context, workerID string, id string) error {
+	return r.updateOutboxMessage(workerID, id, releaseLease)
+}
+
+func (r *repository) GetOutboxBacklog(ctx context.Context) (OutboxBacklog, error) {
+	defer r.rlock()()
+
+	pending := r.pendingOutboxMessages()
+	if len(pending) == 0 {
+		return OutboxBacklog{}, nil
+	}
+
+	return OutboxBacklog{Pending: len(pending), OldestCreatedAt: pending[0].CreatedAt}, nil
+}
+
+// pendingOutboxMessages returns the pending messages ordered by CreatedAt. It must be called with the lock
+// held.
+func (r *repository) pendingOutboxMessages() []*OutboxMessage {
 	var messages []*OutboxMessage
 	for _, msg := range r.outbox {
-		if msg.Status == "pending" {
+		if msg.Status == OutboxStatusPending {
 			messages = append(messages, msg)
 		}
 	}
 
-	return messages, nil
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+	})
+
+	return messages
 }
 
-func (r *repository) MarkOutboxMessageAsProcessed(ctx context.Context, id string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+func (r *repository) MarkOutboxMessageAsProcessed(ctx context.Context, workerID string, id string) error {
+	return r.updateOutboxMessage(workerID, id, func(msg *OutboxMessage) {
+		releaseLease(msg)
+		msg.Status = OutboxStatusProcessed
+		msg.ProcessedAt = time.Now()
+	})
+}
+
+func (r *repository) MarkOutboxMessageAsRetried(
+	ctx context.Context,
+	workerID string,
+	id string,
+	lastError string,
+	nextAttemptAt time.Time,
+) error {
+	return r.updateOutboxMessage(workerID, id, func(msg *OutboxMessage) {
+		releaseLease(msg)
+		msg.Attempts++
+		msg.LastError = lastError
+		msg.NextAttemptAt = nextAttemptAt
+	})
+}
 
-	if msg, exists := r.outbox[id]; exists {
-		msg.Status = "processed"
-		return nil
+func (r *repository) MarkOutboxMessageAsFailed(
+	ctx context.Context,
+	workerID string,
+	id string,
+	lastError string,
+) error {
+	return r.updateOutboxMessage(workerID, id, func(msg *OutboxMessage) {
+		releaseLease(msg)
+		msg.Attempts++
+		msg.LastError = lastError
+		msg.Status = OutboxStatusFailed
+		msg.ProcessedAt = time.Now()
+	})
+}
+
+func releaseLease(msg *OutboxMessage) {
+	msg.ClaimedBy = ""
+	msg.LeaseUntil = time.Time{}
+}
+
+func (r *repository) PurgeOutboxMessages(
+	ctx context.Context,
+	processedBefore time.Time,
+	keepLast int,
+) (int, error) {
+	defer r.lock()()
+
+	var processed []*OutboxMessage
+	for _, msg := range r.outbox {
+		if msg.Status == OutboxStatusProcessed || msg.Status == OutboxStatusFailed {
+			processed = append(processed, msg)
+		}
+	}
+
+	// Newest first, so the messages to keep come first.
+	sort.Slice(processed, func(i, j int) bool {
+		return processed[i].ProcessedAt.After(processed[j].ProcessedAt)
+	})
+
+	purged := 0
+	for i, msg := range processed {
+		if (keepLast > 0 && i >= keepLast) || msg.ProcessedAt.Before(processedBefore) {
+			r.setOutboxMessage(msg.ID, nil)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// updateOutboxMessage replaces the message claimed by workerID with an updated copy instead of changing it,
+// so a rolled back transaction and readers of the old message are not affected.
+func (r *repository) updateOutboxMessage(workerID string, id string, update func(msg *OutboxMessage)) error {
+	defer r.lock()()
+
+	msg, exists := r.outbox[id]
+	if !exists {
+		return ErrOutboxMessageNotFound
 	}
+	if msg.ClaimedBy != workerID {
+		return ErrOutboxLeaseLost
+	}
+
+	updated := *msg
+	update(&updated)
+	r.setOutboxMessage(id, &updated)
 
-	return errors.New("outbox message not found")
+	return nil
 }
 
 func (r *repository) Create(ctx context.Context, order *domain.Order) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	defer r.lock()()
 
 	if _, exists := r.orders[order.ID]; exists {
 		return ErrOrderAlreadyExists
 	}
 
-	r.orders[order.ID] = order
+	r.setOrder(order.ID, order)
 
 	return nil
 }
 
 func (r *repository) Get(ctx context.Context, id string) (*domain.Order, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	defer r.rlock()()
 
 	order, exists := r.orders[id]
 	if !exists {
@@ -107,38 +451,37 @@ func (r *repository) Get(ctx context.Context, id string) (*domain.Order, error)
 }
 
 func (r *repository) Update(ctx context.Context, order *domain.Order) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	defer r.lock()()
 
 	if _, exists := r.orders[order.ID]; !exists {
 		return ErrOrderNotFound
 	}
 
-	r.orders[order.ID] = order
+	r.setOrder(order.ID, order)
 
 	return nil
 }
 
 func (r *repository) Delete(ctx context.Context, id string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	defer r.lock()()
 
 	if _, exists := r.orders[id]; !exists {
 		return ErrOrderNotFound
 	}
 
-	delete(r.orders, id)
+	r.setOrder(id, nil)
 
 	return nil
 }
 
-func (r *repository) List(ctx context.Context) ([]*domain.Order, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+func (r *repository) List(ctx context.Context, customerID string) ([]*domain.Order, error) {
+	defer r.rlock()()
 
-	orders := make([]*domain.Order, 0, len(r.orders))
+	orders := make([]*domain.Order, 0)
 	for _, order := range r.orders {
-		orders = append(orders, order)
+		if order.CustomerID == customerID {
+			orders = append(orders, order)
+		}
 	}
 
 	return orders, nil
@@ -0,0 +1,14 @@
+package order_test
+
+import (
+	"testing"
+
+	"go-microservices-observability/internal/adapters/repository/order"
+	"go-microservices-observability/internal/adapters/repository/order/ordertest"
+)
+
+func TestRepository(t *testing.T) {
+	ordertest.RunRepositorySuite(t, func(t *testing.T) order.Repository {
+		return order.NewRepository()
+	})
+}
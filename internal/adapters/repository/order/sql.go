@@ -0,0 +1,510 @@
+package order
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-microservices-observability/internal/adapters/repository/sqldb"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/pkg/tracing"
+	"io/fs"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+const outboxColumns = `id, topic, message, headers, created_at, status, attempts, last_error, next_attempt_at,
+	processed_at, claimed_by, lease_until`
+
+type sqlRepository struct {
+	db     *sql.DB
+	q      sqldb.Querier
+	tracer tracing.Tracer
+	signal chan struct{}
+	// tx is set on the repository passed to a transaction. stored records whether the transaction stored
+	// outbox messages, which are signaled on commit.
+	tx     *sql.Tx
+	stored bool
+}
+
+// NewSQLRepository creates an order repository stored in db and migrates its schema.
+func NewSQLRepository(ctx context.Context, db *sql.DB, tracer tracing.Tracer) (Repository, error) {
+	sub, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sqldb.Migrate(ctx, db, "order", sub); err != nil {
+		return nil, err
+	}
+
+	return &sqlRepository{
+		db:     db,
+		q:      sqldb.Trace(db, tracer),
+		tracer: tracer,
+		signal: make(chan struct{}, 1),
+	}, nil
+}
+
+func (r *sqlRepository) WithinTx(ctx context.Context, fn func(tx Repository) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+
+	sqlTx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() { _ = sqlTx.Rollback() }()
+
+	tx := &sqlRepository{
+		db:     r.db,
+		q:      sqldb.Trace(sqlTx, r.tracer),
+		tracer: r.tracer,
+		signal: r.signal,
+		tx:     sqlTx,
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := sqlTx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if tx.stored {
+		r.notify()
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) List(ctx context.Context, customerID string) ([]*domain.Order, error) {
+	rows, err := r.q.QueryContext(
+		ctx,
+		"SELECT id, customer_id, product_ids, status, status_reason FROM orders WHERE customer_id = ? ORDER BY rowid",
+		customerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := make([]*domain.Order, 0)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, rows.Err()
+}
+
+func (r *sqlRepository) Get(ctx context.Context, id string) (*domain.Order, error) {
+	row := r.q.QueryRowContext(
+		ctx,
+		"SELECT id, customer_id, product_ids, status, status_reason FROM orders WHERE id = ?",
+		id,
+	)
+
+	order, err := scanOrder(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+
+	return order, err
+}
+
+func (r *sqlRepository) Create(ctx context.Context, order *domain.Order) error {
+	productIDs, err := json.Marshal(order.ProductIDs)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.q.ExecContext(
+		ctx,
+		"INSERT INTO orders (id, customer_id, product_ids, status, status_reason) VALUES (?, ?, ?, ?, ?)",
+		order.ID,
+		order.CustomerID,
+		string(productIDs),
+		string(order.Status),
+		order.StatusReason,
+	)
+	if sqldb.IsUniqueViolation(err) {
+		return ErrOrderAlreadyExists
+	}
+
+	return err
+}
+
+func (r *sqlRepository) Update(ctx context.Context, order *domain.Order) error {
+	productIDs, err := json.Marshal(order.ProductIDs)
+	if err != nil {
+		return err
+	}
+
+	result, err := r.q.ExecContext(
+		ctx,
+		"UPDATE orders SET customer_id = ?, product_ids = ?, status = ?, status_reason = ? WHERE id = ?",
+		order.CustomerID,
+		string(productIDs),
+		string(order.Status),
+		order.StatusReason,
+		order.ID,
+	)
+
+	return expectAffected(result, err, ErrOrderNotFound)
+}
+
+func (r *sqlRepository) Delete(ctx context.Context, id string) error {
+	result, err := r.q.ExecContext(ctx, "DELETE FROM orders WHERE id = ?", id)
+
+	return expectAffected(result, err, ErrOrderNotFound)
+}
+
+func (r *sqlRepository) StoreOutboxMessage(ctx context.Context, message *OutboxMessage) error {
+	headers, err := json.Marshal(message.Headers)
+	if err != nil {
+		return err
+	}
+
+	message.CreatedAt = time.Now()
+	message.Status = OutboxStatusPending
+
+	_, err = r.q.ExecContext(
+		ctx,
+		"INSERT INTO outbox_messages (id, topic, message, headers, created_at, status) VALUES (?, ?, ?, ?, ?, ?)",
+		message.ID,
+		message.Topic,
+		message.Message,
+		string(headers),
+		sqldb.TimeToNanos(message.CreatedAt),
+		message.Status,
+	)
+	if err != nil {
+		return err
+	}
+
+	if r.tx != nil {
+		r.stored = true
+	} else {
+		r.notify()
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) OutboxSignal() <-chan struct{} {
+	return r.signal
+}
+
+// notify signals stored outbox messages without blocking, a pending signal already covers them.
+func (r *sqlRepository) notify() {
+	select {
+	case r.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (r *sqlRepository) ClaimOutboxMessages(
+	ctx context.Context,
+	workerID string,
+	limit int,
+	leaseUntil time.Time,
+) ([]*OutboxMessage, error) {
+	var claimed []*OutboxMessage
+	// The transaction begins immediately (see sqldb.Open), so workers of other instances wait for the claim
+	// instead of claiming the same messages.
+	err := r.WithinTx(ctx, func(tx Repository) error {
+		now := time.Now()
+		claimable, err := tx.(*sqlRepository).claimableOutboxMessages(ctx, now, limit)
+		if err != nil {
+			return err
+		}
+
+		blocked := make(map[string]bool)
+		for _, msg := range claimable {
+			if blocked[msg.Topic] {
+				continue
+			}
+
+			// Guarded by the lease as well, should another worker have claimed the message anyway.
+			result, err := tx.(*sqlRepository).q.ExecContext(
+				ctx,
+				`UPDATE outbox_messages SET claimed_by = ?, lease_until = ?
+				WHERE id = ? AND status = ? AND (claimed_by = '' OR lease_until <= ?)`,
+				workerID,
+				sqldb.TimeToNanos(leaseUntil),
+				msg.ID,
+				OutboxStatusPending,
+				now.UnixNano(),
+			)
+			err = expectAffected(result, err, ErrOutboxLeaseLost)
+			if errors.Is(err, ErrOutboxLeaseLost) {
+				blocked[msg.Topic] = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			msg.ClaimedBy = workerID
+			msg.LeaseUntil = leaseUntil
+			claimed = append(claimed, msg)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+func (r *sqlRepository) ReleaseOutboxMessage(ctx context.Context, workerID string, id string) error {
+	result, err := r.q.ExecContext(
+		ctx,
+		"UPDATE outbox_messages SET claimed_by = '', lease_until = 0 WHERE id = ? AND claimed_by = ?",
+		id,
+		workerID,
+	)
+
+	return r.expectClaimed(ctx, result, err, id)
+}
+
+func (r *sqlRepository) GetOutboxBacklog(ctx context.Context) (OutboxBacklog, error) {
+	var backlog OutboxBacklog
+	var oldest sql.NullInt64
+	err := r.q.QueryRowContext(
+		ctx,
+		"SELECT COUNT(*), MIN(created_at) FROM outbox_messages WHERE status = ?",
+		OutboxStatusPending,
+	).Scan(&backlog.Pending, &oldest)
+	if err != nil {
+		return OutboxBacklog{}, err
+	}
+
+	backlog.OldestCreatedAt = sqldb.NanosToTime(oldest.Int64)
+
+	return backlog, nil
+}
+
+func (r *sqlRepository) MarkOutboxMessageAsProcessed(ctx context.Context, workerID string, id string) error {
+	result, err := r.q.ExecContext(
+		ctx,
+		`UPDATE outbox_messages SET status = ?, processed_at = ?, claimed_by = '', lease_until = 0
+		WHERE id = ? AND claimed_by = ?`,
+		OutboxStatusProcessed,
+		sqldb.TimeToNanos(time.Now()),
+		id,
+		workerID,
+	)
+
+	return r.expectClaimed(ctx, result, err, id)
+}
+
+func (r *sqlRepository) MarkOutboxMessageAsRetried(
+	ctx context.Context,
+	workerID string,
+	id string,
+	lastError string,
+	nextAttemptAt time.Time,
+) error {
+	result, err := r.q.ExecContext(
+		ctx,
+		`UPDATE outbox_messages SET attempts = attempts + 1, last_error = ?, next_attempt_at = ?, claimed_by = '',
+		lease_until = 0 WHERE id = ? AND claimed_by = ?`,
+		lastError,
+		sqldb.TimeToNanos(nextAttemptAt),
+		id,
+		workerID,
+	)
+
+	return r.expectClaimed(ctx, result, err, id)
+}
+
+func (r *sqlRepository) MarkOutboxMessageAsFailed(
+	ctx context.Context,
+	workerID string,
+	id string,
+	lastError string,
+) error {
+	result, err := r.q.ExecContext(
+		ctx,
+		`UPDATE outbox_messages SET status = ?, attempts = attempts + 1, last_error = ?, processed_at = ?,
+		claimed_by = '', lease_until = 0 WHERE id = ? AND claimed_by = ?`,
+		OutboxStatusFailed,
+		lastError,
+		sqldb.TimeToNanos(time.Now()),
+		id,
+		workerID,
+	)
+
+	return r.expectClaimed(ctx, result, err, id)
+}
+
+func (r *sqlRepository) PurgeOutboxMessages(
+	ctx context.Context,
+	processedBefore time.Time,
+	keepLast int,
+) (int, error) {
+	// A negative LIMIT has no upper bound in SQLite, so the subquery keeps every message and a zero keepLast
+	// purges by age only.
+	keep := int64(keepLast)
+	if keepLast <= 0 {
+		keep = -1
+	}
+
+	result, err := r.q.ExecContext(
+		ctx,
+		`DELETE FROM outbox_messages WHERE status IN (?, ?) AND (processed_at < ? OR id NOT IN (
+			SELECT id FROM outbox_messages WHERE status IN (?, ?) ORDER BY processed_at DESC LIMIT ?
+		))`,
+		OutboxStatusProcessed,
+		OutboxStatusFailed,
+		sqldb.TimeToNanos(processedBefore),
+		OutboxStatusProcessed,
+		OutboxStatusFailed,
+		keep,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+
+	return int(purged), err
+}
+
+// claimableOutboxMessages returns up to limit pending messages ordered by CreatedAt that are neither leased
+// nor waiting for a retry at now, and only follow claimable messages of their topic.
+func (r *sqlRepository) claimableOutboxMessages(
+	ctx context.Context,
+	now time.Time,
+	limit int,
+) ([]*OutboxMessage, error) {
+	rows, err := r.q.QueryContext(
+		ctx,
+		"SELECT "+outboxColumns+` FROM outbox_messages m
+		WHERE status = ? AND (claimed_by = '' OR lease_until <= ?) AND next_attempt_at <= ?
+		AND NOT EXISTS (
+			SELECT 1 FROM outbox_messages blocking
+			WHERE blocking.topic = m.topic AND blocking.status = ?
+			AND (blocking.created_at, blocking.rowid) < (m.created_at, m.rowid)
+			AND ((blocking.claimed_by != '' AND blocking.lease_until > ?) OR blocking.next_attempt_at > ?)
+		)
+		ORDER BY created_at, rowid
+		LIMIT ?`,
+		OutboxStatusPending,
+		now.UnixNano(),
+		now.UnixNano(),
+		OutboxStatusPending,
+		now.UnixNano(),
+		now.UnixNano(),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		var headers string
+		var createdAt, nextAttemptAt, processedAt, leaseUntil int64
+		err := rows.Scan(
+			&msg.ID,
+			&msg.Topic,
+			&msg.Message,
+			&headers,
+			&createdAt,
+			&msg.Status,
+			&msg.Attempts,
+			&msg.LastError,
+			&nextAttemptAt,
+			&processedAt,
+			&msg.ClaimedBy,
+			&leaseUntil,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(headers), &msg.Headers); err != nil {
+			return nil, fmt.Errorf("invalid headers of outbox message %s: %w", msg.ID, err)
+		}
+		msg.CreatedAt = sqldb.NanosToTime(createdAt)
+		msg.NextAttemptAt = sqldb.NanosToTime(nextAttemptAt)
+		msg.ProcessedAt = sqldb.NanosToTime(processedAt)
+		msg.LeaseUntil = sqldb.NanosToTime(leaseUntil)
+
+		messages = append(messages, &msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanOrder(row scanner) (*domain.Order, error) {
+	var order domain.Order
+	var productIDs, status string
+	if err := row.Scan(&order.ID, &order.CustomerID, &productIDs, &status, &order.StatusReason); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(productIDs), &order.ProductIDs); err != nil {
+		return nil, fmt.Errorf("invalid product IDs of order %s: %w", order.ID, err)
+	}
+	order.Status = domain.OrderStatus(status)
+
+	return &order, nil
+}
+
+// expectClaimed is like expectAffected for an update of a message claimed by a worker. It tells a missing
+// message from one the worker lost the lease of.
+func (r *sqlRepository) expectClaimed(ctx context.Context, result sql.Result, err error, id string) error {
+	err = expectAffected(result, err, ErrOutboxLeaseLost)
+	if !errors.Is(err, ErrOutboxLeaseLost) {
+		return err
+	}
+
+	var exists bool
+	err = r.q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM outbox_messages WHERE id = ?)", id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrOutboxMessageNotFound
+	}
+
+	return ErrOutboxLeaseLost
+}
+
+// expectAffected returns notFound if the statement didn't affect any row.
+func expectAffected(result sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return notFound
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package order_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go-microservices-observability/internal/adapters/repository/order"
+	"go-microservices-observability/internal/adapters/repository/order/ordertest"
+	"go-microservices-observability/internal/adapters/repository/sqldb"
+	"go-microservices-observability/pkg/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSQLRepository(t *testing.T) {
+	tracer := tracing.NewTracer("test", tracetest.NewInMemoryExporter())
+
+	ordertest.RunRepositorySuite(t, func(t *testing.T) order.Repository {
+		db, err := sqldb.Open(filepath.Join(t.TempDir(), "orders.db"))
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+
+		repo, err := order.NewSQLRepository(context.Background(), db, tracer)
+		if err != nil {
+			t.Fatalf("failed to create repository: %v", err)
+		}
+
+		return repo
+	})
+}
+
+func TestSQLRepository_InstancesClaimDistinctMessages(t *testing.T) {
+	ctx := context.Background()
+	tracer := tracing.NewTracer("test", tracetest.NewInMemoryExporter())
+	path := filepath.Join(t.TempDir(), "orders.db")
+
+	// Every instance opens the database on its own.
+	repos := make([]order.Repository, 2)
+	for i := range repos {
+		db, err := sqldb.Open(path)
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+
+		repos[i], err = order.NewSQLRepository(ctx, db, tracer)
+		if err != nil {
+			t.Fatalf("failed to create repository: %v", err)
+		}
+	}
+
+	const messages = 50
+	for i := 0; i < messages; i++ {
+		err := repos[0].StoreOutboxMessage(ctx, &order.OutboxMessage{
+			ID:      fmt.Sprintf("message-%d", i),
+			Topic:   fmt.Sprintf("topic-%d", i),
+			Message: []byte(`{}`),
+		})
+		if err != nil {
+			t.Fatalf("failed to store message: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	claimedBy := make(map[string]string)
+	var wg sync.WaitGroup
+	for i, repo := range repos {
+		workerID := fmt.Sprintf("worker-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				claimed, err := repo.ClaimOutboxMessages(ctx, workerID, 3, time.Now().Add(time.Hour))
+				if err != nil {
+					t.Errorf("failed to claim messages: %v", err)
+					return
+				}
+				if len(claimed) > 3 {
+					t.Errorf("expected at most 3 messages, got %d", len(claimed))
+				}
+				if len(claimed) == 0 {
+					return
+				}
+
+				mu.Lock()
+				for _, msg := range claimed {
+					if other, ok := claimedBy[msg.ID]; ok {
+						t.Errorf("message %s claimed by %s and %s", msg.ID, other, workerID)
+					}
+					claimedBy[msg.ID] = workerID
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimedBy) != messages {
+		t.Fatalf("expected all %d messages to be claimed, got %d", messages, len(claimedBy))
+	}
+}
@@ -0,0 +1,144 @@
+// Package sqldb provides the SQLite database shared by the SQL repositories, its schema migrations and
+// traced queries.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Open opens the SQLite database at path and creates it if necessary. The database uses a single
+// connection, so writers never fail on a locked database. Transactions begin immediately, so instances
+// sharing the database wait for each other's transactions rather than reading rows another one changes.
+func Open(path string) (*sql.DB, error) {
+	dsn := fmt.Sprintf(
+		"file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate",
+		path,
+	)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	return db, nil
+}
+
+// Migrate applies the *.sql files of migrations in lexical order, e.g. 0001_create_orders.sql, that are
+// not applied yet. Applied migrations are recorded per component in the schema_migrations table, so
+// several repositories can share a database. Every migration runs in its own transaction.
+func Migrate(ctx context.Context, db *sql.DB, component string, migrations fs.FS) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			component  TEXT NOT NULL,
+			version    TEXT NOT NULL,
+			applied_at INTEGER NOT NULL,
+			PRIMARY KEY (component, version)
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	files, err := fs.Glob(migrations, "*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		version := strings.TrimSuffix(file, ".sql")
+		if err := migrate(ctx, db, component, version, migrations, file); err != nil {
+			return fmt.Errorf("failed to apply migration %s/%s: %w", component, version, err)
+		}
+	}
+
+	return nil
+}
+
+func migrate(ctx context.Context, db *sql.DB, component, version string, migrations fs.FS, file string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var applied int
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT COUNT(*) FROM schema_migrations WHERE component = ? AND version = ?",
+		component,
+		version,
+	).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	statements, err := fs.ReadFile(migrations, file)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, string(statements)); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO schema_migrations (component, version, applied_at) VALUES (?, ?, ?)",
+		component,
+		version,
+		time.Now().UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TimeToNanos stores a time as Unix nanoseconds, keeping the zero time as 0.
+func TimeToNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+// NanosToTime is the inverse of TimeToNanos.
+func NanosToTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
+
+// IsUniqueViolation reports whether err is caused by a violated PRIMARY KEY or UNIQUE constraint.
+func IsUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY || code == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
@@ -0,0 +1,7 @@
+CREATE TABLE users (
+    username        TEXT PRIMARY KEY,
+    password_hash   BLOB NOT NULL,
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    locked_until    INTEGER NOT NULL DEFAULT 0,
+    created_at      INTEGER NOT NULL
+);
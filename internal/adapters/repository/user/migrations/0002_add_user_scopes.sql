@@ -0,0 +1,2 @@
+-- Scopes are space-separated. Existing users keep access to their orders.
+ALTER TABLE users ADD COLUMN scopes TEXT NOT NULL DEFAULT 'orders:read orders:write';
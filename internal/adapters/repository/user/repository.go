@@ -0,0 +1,75 @@
+package user
+
+import (
+	"context"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
+	"slices"
+	"sync"
+)
+
+var ErrUserNotFound = errs.New(errs.ErrNotFound, "user not found")
+var ErrUserAlreadyExists = errs.New(errs.ErrAlreadyExists, "user already exists")
+
+type Repository interface {
+	Get(ctx context.Context, username string) (*domain.User, error)
+	Create(ctx context.Context, user *domain.User) error
+	Update(ctx context.Context, user *domain.User) error
+}
+
+type repository struct {
+	mu    sync.RWMutex
+	users map[string]*domain.User
+}
+
+func NewRepository() Repository {
+	return &repository{
+		users: make(map[string]*domain.User),
+	}
+}
+
+func (r *repository) Get(ctx context.Context, username string) (*domain.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, exists := r.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	// Callers change the returned user before they update it.
+	return clone(user), nil
+}
+
+func (r *repository) Create(ctx context.Context, user *domain.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.users[user.Username]; exists {
+		return ErrUserAlreadyExists
+	}
+
+	r.users[user.Username] = clone(user)
+
+	return nil
+}
+
+func (r *repository) Update(ctx context.Context, user *domain.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.users[user.Username]; !exists {
+		return ErrUserNotFound
+	}
+
+	r.users[user.Username] = clone(user)
+
+	return nil
+}
+
+func clone(user *domain.User) *domain.User {
+	cloned := *user
+	cloned.Scopes = slices.Clone(user.Scopes)
+
+	return &cloned
+}
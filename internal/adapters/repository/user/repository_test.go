@@ -0,0 +1,14 @@
+package user_test
+
+import (
+	"testing"
+
+	"go-microservices-observability/internal/adapters/repository/user"
+	"go-microservices-observability/internal/adapters/repository/user/usertest"
+)
+
+func TestRepository(t *testing.T) {
+	usertest.RunRepositorySuite(t, func(t *testing.T) user.Repository {
+		return user.NewRepository()
+	})
+}
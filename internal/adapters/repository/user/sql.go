@@ -0,0 +1,102 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"go-microservices-observability/internal/adapters/repository/sqldb"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/pkg/tracing"
+	"io/fs"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+type sqlRepository struct {
+	q sqldb.Querier
+}
+
+// NewSQLRepository creates a user repository stored in db and migrates its schema.
+func NewSQLRepository(ctx context.Context, db *sql.DB, tracer tracing.Tracer) (Repository, error) {
+	sub, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sqldb.Migrate(ctx, db, "user", sub); err != nil {
+		return nil, err
+	}
+
+	return &sqlRepository{q: sqldb.Trace(db, tracer)}, nil
+}
+
+func (r *sqlRepository) Get(ctx context.Context, username string) (*domain.User, error) {
+	var user domain.User
+	var scopes string
+	var lockedUntil, createdAt int64
+	err := r.q.QueryRowContext(
+		ctx,
+		`SELECT username, password_hash, scopes, failed_attempts, locked_until, created_at FROM users
+		WHERE username = ?`,
+		username,
+	).Scan(&user.Username, &user.PasswordHash, &scopes, &user.FailedAttempts, &lockedUntil, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.Scopes = strings.Fields(scopes)
+	user.LockedUntil = sqldb.NanosToTime(lockedUntil)
+	user.CreatedAt = sqldb.NanosToTime(createdAt)
+
+	return &user, nil
+}
+
+func (r *sqlRepository) Create(ctx context.Context, user *domain.User) error {
+	_, err := r.q.ExecContext(
+		ctx,
+		`INSERT INTO users (username, password_hash, scopes, failed_attempts, locked_until, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		user.Username,
+		user.PasswordHash,
+		strings.Join(user.Scopes, " "),
+		user.FailedAttempts,
+		sqldb.TimeToNanos(user.LockedUntil),
+		sqldb.TimeToNanos(user.CreatedAt),
+	)
+	if sqldb.IsUniqueViolation(err) {
+		return ErrUserAlreadyExists
+	}
+
+	return err
+}
+
+func (r *sqlRepository) Update(ctx context.Context, user *domain.User) error {
+	result, err := r.q.ExecContext(
+		ctx,
+		"UPDATE users SET password_hash = ?, scopes = ?, failed_attempts = ?, locked_until = ? WHERE username = ?",
+		user.PasswordHash,
+		strings.Join(user.Scopes, " "),
+		user.FailedAttempts,
+		sqldb.TimeToNanos(user.LockedUntil),
+		user.Username,
+	)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package user_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go-microservices-observability/internal/adapters/repository/sqldb"
+	"go-microservices-observability/internal/adapters/repository/user"
+	"go-microservices-observability/internal/adapters/repository/user/usertest"
+	"go-microservices-observability/pkg/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSQLRepository(t *testing.T) {
+	tracer := tracing.NewTracer("test", tracetest.NewInMemoryExporter())
+
+	usertest.RunRepositorySuite(t, func(t *testing.T) user.Repository {
+		db, err := sqldb.Open(filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+
+		repo, err := user.NewSQLRepository(context.Background(), db, tracer)
+		if err != nil {
+			t.Fatalf("failed to create repository: %v", err)
+		}
+
+		return repo
+	})
+}
@@ -0,0 +1,132 @@
+// Package usertest provides a conformance test suite for implementations of user.Repository.
+package usertest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"go-microservices-observability/internal/adapters/repository/user"
+	"go-microservices-observability/internal/domain"
+)
+
+// RepositoryFactory creates an empty repository for a single test.
+type RepositoryFactory func(t *testing.T) user.Repository
+
+// RunRepositorySuite runs the tests every user.Repository has to pass against the repositories created
+// by newRepository.
+func RunRepositorySuite(t *testing.T, newRepository RepositoryFactory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo user.Repository)
+	}{
+		{"CreateAndUpdate", testCreateAndUpdate},
+		{"NotFound", testNotFound},
+		{"AlreadyExists", testAlreadyExists},
+		{"ChangesNeedUpdate", testChangesNeedUpdate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tt.test(t, newRepository(t))
+		})
+	}
+}
+
+func testCreateAndUpdate(t *testing.T, repo user.Repository) {
+	ctx := context.Background()
+
+	created := newUser("alice")
+	if err := repo.Create(ctx, created); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	assertUser(t, mustGet(t, repo, "alice"), created)
+
+	updated := newUser("alice")
+	updated.PasswordHash = []byte("new-hash")
+	updated.Scopes = []string{"orders:read"}
+	updated.FailedAttempts = 2
+	updated.LockedUntil = time.Unix(1700000900, 0)
+	if err := repo.Update(ctx, updated); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	assertUser(t, mustGet(t, repo, "alice"), updated)
+}
+
+func testNotFound(t *testing.T, repo user.Repository) {
+	ctx := context.Background()
+
+	if _, err := repo.Get(ctx, "missing"); !errors.Is(err, user.ErrUserNotFound) {
+		t.Errorf("Get: expected %v, got %v", user.ErrUserNotFound, err)
+	}
+	if err := repo.Update(ctx, newUser("missing")); !errors.Is(err, user.ErrUserNotFound) {
+		t.Errorf("Update: expected %v, got %v", user.ErrUserNotFound, err)
+	}
+}
+
+func testAlreadyExists(t *testing.T, repo user.Repository) {
+	ctx := context.Background()
+	if err := repo.Create(ctx, newUser("alice")); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	duplicate := newUser("alice")
+	duplicate.PasswordHash = []byte("other-hash")
+	if err := repo.Create(ctx, duplicate); !errors.Is(err, user.ErrUserAlreadyExists) {
+		t.Fatalf("expected %v, got %v", user.ErrUserAlreadyExists, err)
+	}
+
+	// The existing user is left unchanged.
+	assertUser(t, mustGet(t, repo, "alice"), newUser("alice"))
+}
+
+func testChangesNeedUpdate(t *testing.T, repo user.Repository) {
+	ctx := context.Background()
+	if err := repo.Create(ctx, newUser("alice")); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	// Changing a user that was read doesn't change the stored user.
+	got := mustGet(t, repo, "alice")
+	got.FailedAttempts = 3
+	got.Scopes[0] = "admin"
+	assertUser(t, mustGet(t, repo, "alice"), newUser("alice"))
+}
+
+func newUser(username string) *domain.User {
+	return &domain.User{
+		Username:     username,
+		PasswordHash: []byte("hash"),
+		Scopes:       []string{"orders:read", "orders:write"},
+		CreatedAt:    time.Unix(1700000000, 0),
+	}
+}
+
+func mustGet(t *testing.T, repo user.Repository, username string) *domain.User {
+	t.Helper()
+
+	got, err := repo.Get(context.Background(), username)
+	if err != nil {
+		t.Fatalf("failed to get user %s: %v", username, err)
+	}
+
+	return got
+}
+
+func assertUser(t *testing.T, got *domain.User, want *domain.User) {
+	t.Helper()
+
+	if got.Username != want.Username ||
+		!bytes.Equal(got.PasswordHash, want.PasswordHash) ||
+		!slices.Equal(got.Scopes, want.Scopes) ||
+		got.FailedAttempts != want.FailedAttempts ||
+		!got.LockedUntil.Equal(want.LockedUntil) ||
+		!got.CreatedAt.Equal(want.CreatedAt) {
+		t.Fatalf("expected user %+v, got %+v", *want, *got)
+	}
+}
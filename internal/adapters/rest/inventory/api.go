@@ -1 +1,161 @@
 package inventory
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go-microservices-observability/internal/adapters/rest/problem"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
+	"go-microservices-observability/internal/services/inventory"
+	"go-microservices-observability/pkg/tracing"
+	"net/http"
+	"net/http/httptest"
+)
+
+type Server struct {
+	e                *echo.Echo
+	inventoryService inventory.Service
+}
+
+func (s *Server) ListenAndServe(port int) error {
+	err := s.e.Start(fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.e.Shutdown(ctx)
+}
+
+func (s *Server) Test(req *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	s.e.ServeHTTP(rec, req)
+
+	return rec.Result()
+}
+
+func NewServer(inventoryService inventory.Service, tracer tracing.Tracer) *Server {
+	e := echo.New()
+
+	s := &Server{
+		e:                e,
+		inventoryService: inventoryService,
+	}
+
+	e.HTTPErrorHandler = problem.HTTPErrorHandler
+	e.Use(middleware.Recover())
+	e.Use(middleware.Logger())
+	e.Use(echo.WrapMiddleware(tracing.NewTracingMiddleware(tracer)))
+	e.Use(problem.Middleware())
+
+	e.GET("/products", func(c echo.Context) error {
+		products, err := s.inventoryService.List(c.Request().Context())
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, products)
+	})
+
+	e.GET("/products/:id", func(c echo.Context) error {
+		id := c.Param("id")
+		product, err := s.inventoryService.Get(c.Request().Context(), id)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, product)
+	})
+
+	e.POST("/products", func(c echo.Context) error {
+		var req CreateProductReq
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		var validationErr errs.ValidationError
+		if req.ID == "" {
+			validationErr.Add("id", "is required")
+		}
+		validateQuantity(&validationErr, req.Quantity)
+		if err := validationErr.Err(); err != nil {
+			return err
+		}
+
+		product := domain.Product{
+			ID:       req.ID,
+			Name:     req.Name,
+			Quantity: *req.Quantity,
+		}
+		if err := s.inventoryService.Create(c.Request().Context(), &product); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, product)
+	})
+
+	e.PUT("/products/:id", func(c echo.Context) error {
+		var req UpdateProductReq
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		var validationErr errs.ValidationError
+		validateQuantity(&validationErr, req.Quantity)
+		if err := validationErr.Err(); err != nil {
+			return err
+		}
+
+		// Reserved stock is owned by the reservations, the rest is replaced.
+		product := domain.Product{
+			ID:       c.Param("id"),
+			Name:     req.Name,
+			Quantity: *req.Quantity,
+			Version:  req.Version,
+		}
+		if err := s.inventoryService.Update(c.Request().Context(), &product); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	e.DELETE("/products/:id", func(c echo.Context) error {
+		id := c.Param("id")
+		if err := s.inventoryService.Delete(c.Request().Context(), id); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	return s
+}
+
+type CreateProductReq struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Quantity *int   `json:"quantity"`
+}
+
+type UpdateProductReq struct {
+	Name     string `json:"name"`
+	Quantity *int   `json:"quantity"`
+	// Version is the version of the product the update is based on.
+	Version int `json:"version"`
+}
+
+// validateQuantity requires the on-hand quantity of a product, which can't be negative.
+func validateQuantity(validationErr *errs.ValidationError, quantity *int) {
+	switch {
+	case quantity == nil:
+		validationErr.Add("quantity", "is required")
+	case *quantity < 0:
+		validationErr.Add("quantity", "must not be negative")
+	}
+}
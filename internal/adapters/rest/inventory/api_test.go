@@ -0,0 +1,140 @@
+package inventory
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	inventoryRepo "go-microservices-observability/internal/adapters/repository/inventory"
+	"go-microservices-observability/internal/adapters/rest/problem"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/services/inventory"
+	"go-microservices-observability/pkg/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	tracer := tracing.NewTracer("test", tracetest.NewInMemoryExporter())
+
+	return NewServer(inventory.NewService(inventoryRepo.NewRepository(), tracer), tracer)
+}
+
+func TestServer_CRUD(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t)
+
+	resp := request(s, http.MethodPost, "/products", `{"id":"p1","name":"Keyboard","quantity":3}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	var created domain.Product
+	decode(t, resp, &created)
+	if created != (domain.Product{ID: "p1", Name: "Keyboard", Quantity: 3, Version: 1}) {
+		t.Fatalf("unexpected created product %+v", created)
+	}
+
+	resp = request(s, http.MethodPut, "/products/p1", `{"name":"Mouse","quantity":5,"version":1}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("update: expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	resp = request(s, http.MethodGet, "/products/p1", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get: expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	var product domain.Product
+	decode(t, resp, &product)
+	if product != (domain.Product{ID: "p1", Name: "Mouse", Quantity: 5, Version: 2}) {
+		t.Fatalf("unexpected updated product %+v", product)
+	}
+
+	// The update is based on the version the first update replaced.
+	resp = request(s, http.MethodPut, "/products/p1", `{"name":"Trackball","quantity":1,"version":1}`)
+	assertProblem(t, resp, http.StatusConflict, "")
+
+	resp = request(s, http.MethodGet, "/products", "")
+	var products []domain.Product
+	decode(t, resp, &products)
+	if len(products) != 1 || products[0].ID != "p1" {
+		t.Fatalf("expected the created product, got %+v", products)
+	}
+
+	resp = request(s, http.MethodDelete, "/products/p1", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		assertProblem(t, request(s, method, "/products/p1", ""), http.StatusNotFound, "")
+	}
+	resp = request(s, http.MethodPut, "/products/p1", `{"name":"Mouse","quantity":5,"version":2}`)
+	assertProblem(t, resp, http.StatusNotFound, "")
+}
+
+func TestServer_ValidatesProducts(t *testing.T) {
+	t.Parallel()
+
+	s := newTestServer(t)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		field  string
+	}{
+		{http.MethodPost, "/products", `{"name":"Keyboard","quantity":3}`, "id"},
+		{http.MethodPost, "/products", `{"id":"p1","name":"Keyboard"}`, "quantity"},
+		{http.MethodPost, "/products", `{"id":"p1","name":"Keyboard","quantity":-1}`, "quantity"},
+		{http.MethodPut, "/products/p1", `{"name":"Keyboard","version":1}`, "quantity"},
+		{http.MethodPut, "/products/p1", `{"name":"Keyboard","quantity":-1,"version":1}`, "quantity"},
+	}
+
+	for _, tt := range tests {
+		resp := request(s, tt.method, tt.path, tt.body)
+		assertProblem(t, resp, http.StatusUnprocessableEntity, tt.field)
+	}
+
+	// Nothing was created by the invalid requests.
+	assertProblem(t, request(s, http.MethodGet, "/products/p1", ""), http.StatusNotFound, "")
+}
+
+func request(s *Server, method string, path string, body string) *http.Response {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return s.Test(req)
+}
+
+func decode(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+}
+
+// assertProblem asserts a problem details response with the status and, if field is set, the invalid field.
+func assertProblem(t *testing.T, resp *http.Response, status int, field string) {
+	t.Helper()
+
+	if resp.StatusCode != status {
+		t.Fatalf("expected status %d, got %d", status, resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, problem.ContentType) {
+		t.Fatalf("expected problem details, got %s", contentType)
+	}
+
+	var details problem.Details
+	decode(t, resp, &details)
+	if field != "" && (len(details.Errors) != 1 || details.Errors[0].Field != field) {
+		t.Fatalf("expected the invalid field %s, got %+v", field, details.Errors)
+	}
+}
@@ -3,18 +3,28 @@ package order
 import (
 	"context"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	order_repository "go-microservices-observability/internal/adapters/repository/order"
+	"go-microservices-observability/internal/adapters/rest/problem"
 	"go-microservices-observability/internal/adapters/user"
+	"go-microservices-observability/internal/auth"
 	"go-microservices-observability/internal/domain"
 	"go-microservices-observability/internal/services/order"
 	"go-microservices-observability/pkg/tracing"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// The policies of the routes of the order API.
+var (
+	readOrdersPolicy  = auth.RequireScope(auth.ScopeOrdersRead)
+	writeOrdersPolicy = auth.RequireScope(auth.ScopeOrdersWrite)
+	adminPolicy       = auth.RequireScope(auth.ScopeAdmin)
 )
 
 type Server struct {
@@ -43,7 +53,12 @@ func (s *Server) Test(req *http.Request) *http.Response {
 	return rec.Result()
 }
 
-func NewServer(orderService order.Service, tracer tracing.Tracer, userClient user.Client) *Server {
+func NewServer(
+	orderService order.Service,
+	tracer tracing.Tracer,
+	userClient user.Client,
+	tokenVerifier *auth.Verifier,
+) *Server {
 	e := echo.New()
 
 	s := &Server{
@@ -52,11 +67,12 @@ func NewServer(orderService order.Service, tracer tracing.Tracer, userClient use
 		userClient:   userClient,
 	}
 
-	e.HTTPErrorHandler = customHTTPErrorHandler
+	e.HTTPErrorHandler = problem.HTTPErrorHandler
 	e.Use(middleware.Recover())
 	e.Use(middleware.Logger())
 	e.Use(echo.WrapMiddleware(tracing.NewTracingMiddleware(tracer)))
-	e.Use(BasicAuthMiddleware(userClient))
+	e.Use(problem.Middleware())
+	e.Use(AuthMiddleware(userClient, tokenVerifier))
 
 	e.GET("/orders", func(c echo.Context) error {
 		orders, err := s.orderService.List(c.Request().Context())
@@ -65,7 +81,7 @@ func NewServer(orderService order.Service, tracer tracing.Tracer, userClient use
 		}
 
 		return c.JSON(http.StatusOK, orders)
-	})
+	}, AuthorizeMiddleware(readOrdersPolicy))
 
 	e.GET("/orders/:id", func(c echo.Context) error {
 		id := c.Param("id")
@@ -75,34 +91,54 @@ func NewServer(orderService order.Service, tracer tracing.Tracer, userClient use
 		}
 
 		return c.JSON(http.StatusOK, order)
-	})
+	}, AuthorizeMiddleware(readOrdersPolicy))
 
 	e.POST("/orders", func(c echo.Context) error {
-		var order domain.Order
-		if err := c.Bind(&order); err != nil {
+		var req CreateOrderReq
+		if err := c.Bind(&req); err != nil {
 			return err
 		}
 
+		// The ID, customer and status of a new order are assigned by the service.
+		order := domain.Order{
+			ProductIDs: req.ProductIDs,
+		}
 		if err := s.orderService.Create(c.Request().Context(), &order); err != nil {
 			return err
 		}
 
-		return c.JSON(http.StatusOK, order)
-	})
+		c.Response().Header().Set(echo.HeaderLocation, "/orders/"+order.ID)
+
+		return c.JSON(http.StatusCreated, order)
+	}, AuthorizeMiddleware(writeOrdersPolicy))
 
 	e.PUT("/orders/:id", func(c echo.Context) error {
-		id := c.Param("id")
-		var order domain.Order
-		if err := c.Bind(&order); err != nil {
+		var req UpdateOrderReq
+		if err := c.Bind(&req); err != nil {
 			return err
 		}
-		order.ID = id
+
+		// Only the items of an order are taken from the request, the service rejects them if they changed.
+		order := domain.Order{
+			ID:         c.Param("id"),
+			ProductIDs: req.ProductIDs,
+		}
 		if err := s.orderService.Update(c.Request().Context(), &order); err != nil {
 			return err
 		}
 
 		return c.NoContent(http.StatusNoContent)
-	})
+	}, AuthorizeMiddleware(writeOrdersPolicy))
+
+	e.POST("/orders/:id/cancel", func(c echo.Context) error {
+		id := c.Param("id")
+		order, err := s.orderService.Cancel(c.Request().Context(), id)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, order)
+	}, AuthorizeMiddleware(writeOrdersPolicy))
 
 	e.DELETE("/orders/:id", func(c echo.Context) error {
 		id := c.Param("id")
@@ -111,53 +147,37 @@ func NewServer(orderService order.Service, tracer tracing.Tracer, userClient use
 		}
 
 		return c.NoContent(http.StatusNoContent)
-	})
+	}, AuthorizeMiddleware(writeOrdersPolicy))
 
-	return s
-}
-
-func customHTTPErrorHandler(rootError error, c echo.Context) {
-	println("customHTTPErrorHandler: ", rootError.Error())
-	err := findHTTPError(c, rootError)
+	// Deletes the processed outbox messages according to the retention policy right away.
+	e.POST("/admin/outbox/compact", func(c echo.Context) error {
+		purged, err := s.orderService.CompactOutbox(c.Request().Context())
+		if err != nil {
+			return err
+		}
 
-	if err == nil {
-		err = rootError
-	}
+		return c.JSON(http.StatusOK, CompactOutboxResp{Purged: purged})
+	}, AuthorizeMiddleware(adminPolicy))
 
-	c.Echo().DefaultHTTPErrorHandler(err, c)
+	return s
 }
 
-func findHTTPError(ctx echo.Context, err error) error {
-	if err == nil {
-		return nil
-	}
-
-	var e *echo.HTTPError
-	if errors.As(err, &e) {
-		return e
-	}
-
-	if errors.Is(err, order_repository.ErrOrderAlreadyExists) {
-		return ctx.JSON(http.StatusConflict, ErrorMessageResp{
-			Message: "order already exists",
-		})
-	}
-
-	if errors.Is(err, order_repository.ErrOrderNotFound) {
-		return ctx.JSON(http.StatusNotFound, ErrorMessageResp{
-			Message: "order not found",
-		})
-	}
+type CreateOrderReq struct {
+	ProductIDs []string `json:"productIds"`
+}
 
-	return findHTTPError(ctx, errors.Unwrap(err))
+type UpdateOrderReq struct {
+	ProductIDs []string `json:"productIds"`
 }
 
-type ErrorMessageResp struct {
-	Message string `json:"message"`
-	Error   string `json:"error,omitempty"`
+type CompactOutboxResp struct {
+	Purged int `json:"purged"`
 }
 
-func BasicAuthMiddleware(userClient user.Client) echo.MiddlewareFunc {
+// AuthMiddleware authenticates requests with a bearer token of the user service, which is validated locally
+// against the cached keys of the user service. Legacy clients can still send the credentials of the user
+// (Basic), which are checked by the user service on every request.
+func AuthMiddleware(userClient user.Client, tokenVerifier *auth.Verifier) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			authHeader := c.Request().Header.Get("Authorization")
@@ -165,31 +185,80 @@ func BasicAuthMiddleware(userClient user.Client) echo.MiddlewareFunc {
 				return echo.NewHTTPError(http.StatusUnauthorized, "missing authorization header")
 			}
 
-			authParts := strings.SplitN(authHeader, " ", 2)
-			if len(authParts) != 2 || authParts[0] != "Basic" {
+			scheme, credentials, ok := strings.Cut(authHeader, " ")
+			if !ok {
 				return echo.NewHTTPError(http.StatusUnauthorized, "invalid authorization header")
 			}
 
-			payload, err := base64.StdEncoding.DecodeString(authParts[1])
+			// Rejected and unavailable user services are told apart by the error handler.
+			ctx := c.Request().Context()
+			var principal auth.Principal
+			var err error
+			switch {
+			case strings.EqualFold(scheme, "Bearer"):
+				principal, err = tokenVerifier.Verify(ctx, credentials)
+			case strings.EqualFold(scheme, "Basic"):
+				principal, err = authenticateBasic(ctx, userClient, credentials)
+			default:
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid authorization header")
+			}
 			if err != nil {
-				return echo.NewHTTPError(http.StatusUnauthorized, "invalid base64 encoding")
+				return err
 			}
 
-			credentials := strings.SplitN(string(payload), ":", 2)
-			if len(credentials) != 2 {
-				return echo.NewHTTPError(http.StatusUnauthorized, "invalid authorization value")
-			}
+			// The services act on behalf of the authenticated user.
+			oteltrace.SpanFromContext(ctx).SetAttributes(
+				attribute.String("enduser.id", principal.Subject),
+				attribute.StringSlice("enduser.scope", principal.Scopes),
+			)
+			ctx = auth.WithPrincipal(ctx, principal)
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			return next(c)
+		}
+	}
+}
 
-			user := user.User{
-				Username: credentials[0],
-				Password: credentials[1],
+// AuthorizeMiddleware allows a route to the principals that policy allows, and responds with 403 to the
+// others. The policy and the decision are recorded on the request span for auditing.
+func AuthorizeMiddleware(policy auth.Policy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+			principal, err := auth.RequirePrincipal(ctx)
+			if err != nil {
+				return err
 			}
 
-			if err := userClient.Authenticate(c.Request().Context(), user); err != nil {
-				return echo.NewHTTPError(http.StatusUnauthorized, "authentication failed")
+			span := oteltrace.SpanFromContext(ctx)
+			span.SetAttributes(attribute.String("authz.policy", policy.Name))
+			if err := policy.Authorize(principal); err != nil {
+				span.SetAttributes(
+					attribute.String("authz.decision", "deny"),
+					attribute.String("authz.reason", err.Error()),
+				)
+				return err
 			}
+			span.SetAttributes(attribute.String("authz.decision", "allow"))
 
 			return next(c)
 		}
 	}
 }
+
+func authenticateBasic(ctx context.Context, userClient user.Client, credentials string) (auth.Principal, error) {
+	payload, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return auth.Principal{}, echo.NewHTTPError(http.StatusUnauthorized, "invalid base64 encoding")
+	}
+
+	username, password, ok := strings.Cut(string(payload), ":")
+	if !ok {
+		return auth.Principal{}, echo.NewHTTPError(http.StatusUnauthorized, "invalid authorization value")
+	}
+
+	return userClient.Authenticate(ctx, user.User{
+		Username: username,
+		Password: password,
+	})
+}
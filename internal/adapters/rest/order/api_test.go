@@ -0,0 +1,85 @@
+package order
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-microservices-observability/internal/auth"
+	"go-microservices-observability/pkg/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestServer_ForbidsRouteWithoutScope(t *testing.T) {
+	t.Parallel()
+
+	signer, err := auth.NewSigner("user-service")
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	keySet := signer.KeySet()
+	keys := auth.NewCachedKeySet(fetcherFunc(func(context.Context) (*auth.JSONWebKeySet, error) {
+		return &keySet, nil
+	}), nil)
+
+	exporter := keepSpansExporter{tracetest.NewInMemoryExporter()}
+	tracer := tracing.NewTracer("order-rest-api-test", exporter)
+	s := NewServer(nil, tracer, nil, auth.NewVerifier(keys, "user-service"))
+
+	token, _, err := signer.Sign(auth.Principal{
+		Subject: "alice",
+		Scopes:  []string{auth.ScopeOrdersRead, auth.ScopeOrdersWrite},
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/outbox/compact", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp := s.Test(req)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/problem+json") {
+		t.Fatalf("expected problem details, got %s", contentType)
+	}
+
+	if err := tracer.Shutdown(); err != nil {
+		t.Fatalf("failed to shut down tracer: %v", err)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected the request span, got %d spans", len(spans))
+	}
+
+	attributes := make(map[string]string)
+	for _, attribute := range spans[0].Attributes {
+		attributes[string(attribute.Key)] = attribute.Value.Emit()
+	}
+	if attributes["authz.policy"] != auth.ScopeAdmin || attributes["authz.decision"] != "deny" {
+		t.Fatalf("expected the admin policy to deny the request, got %v", attributes)
+	}
+	if !strings.Contains(attributes["authz.reason"], "missing scope admin") {
+		t.Fatalf("expected the missing scope as the reason, got %q", attributes["authz.reason"])
+	}
+}
+
+type fetcherFunc func(ctx context.Context) (*auth.JSONWebKeySet, error)
+
+func (f fetcherFunc) FetchKeys(ctx context.Context) (*auth.JSONWebKeySet, error) {
+	return f(ctx)
+}
+
+// keepSpansExporter keeps the exported spans after the tracer is shut down.
+type keepSpansExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keepSpansExporter) Shutdown(context.Context) error {
+	return nil
+}
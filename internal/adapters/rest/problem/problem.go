@@ -0,0 +1,130 @@
+// Package problem reports the errors of the REST APIs as RFC 7807 problem details.
+package problem
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"go-microservices-observability/internal/errs"
+
+	"github.com/labstack/echo/v4"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// ContentType is the media type of a problem details response.
+const ContentType = "application/problem+json"
+
+// Details is an RFC 7807 problem details object.
+type Details struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// TraceID identifies the trace of the failed request.
+	TraceID string `json:"traceId,omitempty"`
+	// Errors lists the invalid fields of a request that failed validation.
+	Errors []errs.FieldError `json:"errors,omitempty"`
+}
+
+// statusByKind maps the kinds of errors to HTTP status codes.
+var statusByKind = []struct {
+	kind   error
+	status int
+}{
+	{errs.ErrNotFound, http.StatusNotFound},
+	{errs.ErrAlreadyExists, http.StatusConflict},
+	{errs.ErrConflict, http.StatusConflict},
+	{errs.ErrValidation, http.StatusUnprocessableEntity},
+	{errs.ErrUnauthorized, http.StatusUnauthorized},
+	{errs.ErrForbidden, http.StatusForbidden},
+	{errs.ErrUnavailable, http.StatusServiceUnavailable},
+}
+
+// HTTPErrorHandler is an echo.HTTPErrorHandler that responds with the problem details of err. Errors
+// of unknown kinds are internal server errors. The messages of server errors are logged but not exposed.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	details := FromError(err)
+	details.Instance = c.Request().URL.Path
+	if spanContext := oteltrace.SpanContextFromContext(c.Request().Context()); spanContext.HasTraceID() {
+		details.TraceID = spanContext.TraceID().String()
+	}
+
+	if details.Status >= http.StatusInternalServerError {
+		log.Printf("Internal error handling %s %s: %v", c.Request().Method, details.Instance, err)
+	}
+
+	if err := Write(c, details); err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// Middleware responds with the problem details of the errors of the next handlers right away, so that
+// middlewares registered before, e.g. the tracing middleware, see the status of the response.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			return nil
+		}
+	}
+}
+
+// FromError returns the problem details of err without the request specific fields.
+func FromError(err error) Details {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		details := newDetails(httpErr.Code)
+		if message, ok := httpErr.Message.(string); ok {
+			details.Detail = message
+		}
+
+		return details
+	}
+
+	for _, mapping := range statusByKind {
+		if errors.Is(err, mapping.kind) {
+			details := newDetails(mapping.status)
+			if mapping.status < http.StatusInternalServerError {
+				details.Detail = err.Error()
+			}
+
+			var validationErr *errs.ValidationError
+			if errors.As(err, &validationErr) {
+				details.Errors = validationErr.Fields
+			}
+
+			return details
+		}
+	}
+
+	return newDetails(http.StatusInternalServerError)
+}
+
+// Write responds with details.
+func Write(c echo.Context, details Details) error {
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(details.Status)
+	}
+
+	// c.JSON keeps a content type set before.
+	c.Response().Header().Set(echo.HeaderContentType, ContentType)
+
+	return c.JSON(details.Status, details)
+}
+
+func newDetails(status int) Details {
+	return Details{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+	}
+}
@@ -0,0 +1,87 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-microservices-observability/internal/errs"
+	"go-microservices-observability/pkg/tracing"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestFromError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err    error
+		status int
+		detail string
+	}{
+		{errs.New(errs.ErrNotFound, "order not found"), http.StatusNotFound, "order not found"},
+		{fmt.Errorf("%w: p1", errs.New(errs.ErrAlreadyExists, "product exists")), http.StatusConflict, "product exists: p1"},
+		{errs.New(errs.ErrConflict, "version conflict"), http.StatusConflict, "version conflict"},
+		{errs.New(errs.ErrValidation, "invalid order"), http.StatusUnprocessableEntity, "invalid order"},
+		{errs.New(errs.ErrUnauthorized, "authentication failed"), http.StatusUnauthorized, "authentication failed"},
+		{errs.New(errs.ErrForbidden, "missing scope admin"), http.StatusForbidden, "missing scope admin"},
+		{fmt.Errorf("%w: connection refused", errs.ErrUnavailable), http.StatusServiceUnavailable, ""},
+		{echo.NewHTTPError(http.StatusBadRequest, "invalid body"), http.StatusBadRequest, "invalid body"},
+		{errors.New("disk full"), http.StatusInternalServerError, ""},
+	}
+
+	for _, tt := range tests {
+		details := FromError(tt.err)
+		if details.Status != tt.status || details.Detail != tt.detail || details.Title != http.StatusText(tt.status) {
+			t.Errorf("%v: expected status %d and detail %q, got %+v", tt.err, tt.status, tt.detail, details)
+		}
+	}
+}
+
+func TestFromError_ListsInvalidFields(t *testing.T) {
+	t.Parallel()
+
+	var validationErr errs.ValidationError
+	validationErr.Add("customerId", "is required")
+	validationErr.Add("productIds[1]", "refers to unknown product p9")
+
+	details := FromError(fmt.Errorf("failed to create order: %w", validationErr.Err()))
+	if details.Status != http.StatusUnprocessableEntity || len(details.Errors) != 2 {
+		t.Fatalf("expected 422 with 2 invalid fields, got %+v", details)
+	}
+	if details.Errors[1] != (errs.FieldError{Field: "productIds[1]", Message: "refers to unknown product p9"}) {
+		t.Fatalf("unexpected invalid field: %+v", details.Errors[1])
+	}
+}
+
+func TestMiddleware_RespondsWithProblemAndTraceID(t *testing.T) {
+	t.Parallel()
+
+	exporter := tracetest.NewInMemoryExporter()
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.Use(echo.WrapMiddleware(tracing.NewTracingMiddleware(tracing.NewTracer("test", exporter))))
+	e.Use(Middleware())
+	e.GET("/orders/:id", func(c echo.Context) error {
+		return errs.New(errs.ErrNotFound, "order not found")
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/orders/o1", nil))
+
+	if rec.Code != http.StatusNotFound || rec.Header().Get(echo.HeaderContentType) != ContentType {
+		t.Fatalf("expected 404 %s, got %d %s", ContentType, rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+
+	var details Details
+	if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil {
+		t.Fatalf("failed to unmarshal problem: %v", err)
+	}
+	if details.Instance != "/orders/o1" || details.Detail != "order not found" || len(details.TraceID) != 32 {
+		t.Fatalf("unexpected problem: %+v", details)
+	}
+}
@@ -2,19 +2,22 @@ package user
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"go-microservices-observability/internal/services/order"
+	"go-microservices-observability/internal/adapters/rest/problem"
+	"go-microservices-observability/internal/services/user"
 	"go-microservices-observability/pkg/tracing"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type Server struct {
-	e            *echo.Echo
-	orderService order.Service
+	e           *echo.Echo
+	userService user.Service
 }
 
 func (s *Server) ListenAndServe(port int) error {
@@ -37,51 +40,139 @@ func (s *Server) Test(req *http.Request) *http.Response {
 	return rec.Result()
 }
 
-func NewServer(tracer tracing.Tracer) *Server {
+func NewServer(userService user.Service, tracer tracing.Tracer) *Server {
 	e := echo.New()
 
 	s := &Server{
-		e: e,
+		e:           e,
+		userService: userService,
 	}
 
-	e.HTTPErrorHandler = customHTTPErrorHandler
+	e.HTTPErrorHandler = problem.HTTPErrorHandler
 	e.Use(middleware.Recover())
 	e.Use(middleware.Logger())
 	e.Use(echo.WrapMiddleware(tracing.NewTracingMiddleware(tracer)))
+	e.Use(problem.Middleware())
 
+	e.POST("/users", func(c echo.Context) error {
+		var req RegisterReq
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		user, err := s.userService.Register(c.Request().Context(), req.Username, req.Password)
+		if err != nil {
+			return err
+		}
+
+		c.Response().Header().Set(echo.HeaderLocation, "/users/"+url.PathEscape(user.Username))
+
+		return c.JSON(http.StatusCreated, user)
+	})
+
+	e.PUT("/users/:username/password", func(c echo.Context) error {
+		var req ChangePasswordReq
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		err := s.userService.ChangePassword(
+			c.Request().Context(),
+			c.Param("username"),
+			req.CurrentPassword,
+			req.NewPassword,
+		)
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	// Responds with 401 and the reason, e.g. a locked account, if the credentials are rejected.
 	e.POST("/authenticate", func(c echo.Context) error {
-		return c.JSON(http.StatusOK, ErrorMessageResp{
+		var req AuthenticateReq
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		user, err := s.userService.Authenticate(c.Request().Context(), req.Username, req.Password)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, AuthenticateResp{
 			Message: "authenticated",
+			Subject: user.Username,
+			Scopes:  user.Scopes,
 		})
 	})
 
+	// Issues a bearer token for the credentials, which is validated against the keys of the JWKS endpoint.
+	e.POST("/token", func(c echo.Context) error {
+		var req TokenReq
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		token, err := s.userService.IssueToken(
+			c.Request().Context(),
+			req.Username,
+			req.Password,
+			strings.Fields(req.Scope),
+		)
+		if err != nil {
+			return err
+		}
+
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+
+		return c.JSON(http.StatusOK, TokenResp{
+			AccessToken: token.AccessToken,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(time.Until(token.ExpiresAt).Seconds()),
+			Scope:       strings.Join(token.Scopes, " "),
+		})
+	})
+
+	e.GET("/.well-known/jwks.json", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, s.userService.KeySet(c.Request().Context()))
+	})
+
 	return s
 }
 
-func customHTTPErrorHandler(rootError error, c echo.Context) {
-	err := findHTTPError(c, rootError)
-
-	if err == nil {
-		err = rootError
-	}
+type RegisterReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
 
-	c.Echo().DefaultHTTPErrorHandler(err, c)
+type ChangePasswordReq struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
 }
 
-func findHTTPError(ctx echo.Context, err error) error {
-	if err == nil {
-		return nil
-	}
+type AuthenticateReq struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
 
-	var e *echo.HTTPError
-	if errors.As(err, &e) {
-		return e
-	}
+type AuthenticateResp struct {
+	Message string   `json:"message"`
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+}
 
-	return findHTTPError(ctx, errors.Unwrap(err))
+type TokenReq struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+	// Scope is the space-separated list of the requested scopes, all scopes of the user if empty.
+	Scope string `json:"scope" form:"scope"`
 }
 
-type ErrorMessageResp struct {
-	Message string `json:"message"`
-	Error   string `json:"error,omitempty"`
+type TokenResp struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
 }
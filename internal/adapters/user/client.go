@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"go-microservices-observability/internal/auth"
+	"go-microservices-observability/internal/errs"
 	"go-microservices-observability/pkg/tracing"
 	"net/http"
 )
 
+var ErrAuthenticationFailed = errs.New(errs.ErrUnauthorized, "authentication failed")
+
 type Config struct {
 	Address    string
 	HTTPClient *http.Client
@@ -17,7 +20,10 @@ type Config struct {
 }
 
 type Client interface {
-	Authenticate(ctx context.Context, user User) error
+	// Authenticate checks the credentials of a user and returns the user with their scopes.
+	Authenticate(ctx context.Context, user User) (auth.Principal, error)
+	// FetchKeys fetches the key set that the tokens of the user service are signed with.
+	FetchKeys(ctx context.Context) (*auth.JSONWebKeySet, error)
 }
 
 type client struct {
@@ -29,10 +35,10 @@ type User struct {
 	Password string `json:"password"`
 }
 
-func (c client) Authenticate(ctx context.Context, user User) error {
+func (c client) Authenticate(ctx context.Context, user User) (auth.Principal, error) {
 	b, err := json.Marshal(user)
 	if err != nil {
-		return err
+		return auth.Principal{}, err
 	}
 
 	req, err := http.NewRequestWithContext(
@@ -42,21 +48,73 @@ func (c client) Authenticate(ctx context.Context, user User) error {
 		bytes.NewBuffer(b),
 	)
 	if err != nil {
-		return err
+		return auth.Principal{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	c.config.Tracer.InjectHTTP(ctx, req.Header)
+
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return auth.Principal{}, fmt.Errorf("%w: user service: %v", errs.ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var authenticated struct {
+			Subject string   `json:"subject"`
+			Scopes  []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&authenticated); err != nil {
+			return auth.Principal{}, fmt.Errorf("%w: invalid response of user service: %v", errs.ErrUnavailable, err)
+		}
+
+		return auth.Principal{Subject: authenticated.Subject, Scopes: authenticated.Scopes}, nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		// The user service explains the rejection in the problem details, e.g. a locked account.
+		var problem struct {
+			Detail string `json:"detail"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&problem); err != nil || problem.Detail == "" {
+			return auth.Principal{}, ErrAuthenticationFailed
+		}
+
+		return auth.Principal{}, fmt.Errorf("%w: %s", ErrAuthenticationFailed, problem.Detail)
+	default:
+		return auth.Principal{}, fmt.Errorf("%w: user service responded with %s", errs.ErrUnavailable, resp.Status)
+	}
+}
+
+func (c client) FetchKeys(ctx context.Context) (*auth.JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf("%s/.well-known/jwks.json", c.config.Address),
+		nil,
+	)
+	if err != nil {
+		return nil, err
 	}
 
 	c.config.Tracer.InjectHTTP(ctx, req.Header)
 
 	resp, err := c.config.HTTPClient.Do(req)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: user service: %v", errs.ErrUnavailable, err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New("authentication failed")
+		return nil, fmt.Errorf("%w: user service responded with %s", errs.ErrUnavailable, resp.Status)
+	}
+
+	var keySet auth.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return nil, fmt.Errorf("%w: invalid key set of user service: %v", errs.ErrUnavailable, err)
 	}
 
-	return nil
+	return &keySet, nil
 }
 
 func NewClient(config *Config) Client {
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go-microservices-observability/internal/errs"
+)
+
+// ErrKeysUnavailable is returned while no key set has been fetched yet, so tokens can't be verified at all.
+var ErrKeysUnavailable = errs.New(errs.ErrUnavailable, "token keys unavailable")
+
+// KeyFetcher fetches the current key set of an issuer, e.g. from its JWKS endpoint.
+type KeyFetcher interface {
+	FetchKeys(ctx context.Context) (*JSONWebKeySet, error)
+}
+
+// CachedKeySetConfig configures a CachedKeySet.
+type CachedKeySetConfig struct {
+	// TTL is the time the fetched keys are used before they are fetched again. Defaults to 5 minutes.
+	TTL time.Duration
+	// MinRefreshInterval is the minimum time between two fetches, so tokens with unknown key IDs or an
+	// unavailable issuer don't cause a fetch on every request. Defaults to 10 seconds.
+	MinRefreshInterval time.Duration
+	// FetchTimeout bounds a fetch, which doesn't end with the request that started it. Defaults to 5
+	// seconds.
+	FetchTimeout time.Duration
+}
+
+const (
+	defaultKeySetTTL                = 5 * time.Minute
+	defaultKeySetMinRefreshInterval = 10 * time.Second
+	defaultKeySetFetchTimeout       = 5 * time.Second
+)
+
+// CachedKeySet is a KeySource that caches the keys of a KeyFetcher. Keys are fetched again once the TTL
+// expired or a token refers to an unknown key, e.g. after the issuer rotated its key. If the issuer is not
+// available, the expired keys are used until it is again. Until the keys were fetched once, every token
+// is rejected with ErrKeysUnavailable.
+type CachedKeySet struct {
+	fetcher            KeyFetcher
+	ttl                time.Duration
+	minRefreshInterval time.Duration
+	fetchTimeout       time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]ed25519.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetchErr    error
+	// fetching is closed once the running fetch finished, concurrent requests wait for it instead of
+	// fetching the keys themselves. It is nil while no fetch is running.
+	fetching chan struct{}
+}
+
+func NewCachedKeySet(fetcher KeyFetcher, config *CachedKeySetConfig) *CachedKeySet {
+	if config == nil {
+		config = &CachedKeySetConfig{}
+	}
+
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = defaultKeySetTTL
+	}
+
+	minRefreshInterval := config.MinRefreshInterval
+	if minRefreshInterval <= 0 {
+		minRefreshInterval = defaultKeySetMinRefreshInterval
+	}
+
+	fetchTimeout := config.FetchTimeout
+	if fetchTimeout <= 0 {
+		fetchTimeout = defaultKeySetFetchTimeout
+	}
+
+	return &CachedKeySet{
+		fetcher:            fetcher,
+		ttl:                ttl,
+		minRefreshInterval: minRefreshInterval,
+		fetchTimeout:       fetchTimeout,
+	}
+}
+
+func (c *CachedKeySet) Key(ctx context.Context, keyID string) (ed25519.PublicKey, error) {
+	c.mu.Lock()
+
+	now := time.Now()
+	key, known := c.keys[keyID]
+	if known && now.Sub(c.fetchedAt) < c.ttl {
+		c.mu.Unlock()
+		return key, nil
+	}
+
+	if c.fetching == nil && now.Sub(c.attemptedAt) >= c.minRefreshInterval {
+		c.attemptedAt = now
+		c.fetching = make(chan struct{})
+		go c.fetch(ctx, c.fetching)
+	}
+
+	fetching := c.fetching
+	c.mu.Unlock()
+
+	if fetching != nil {
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return c.cached(keyID)
+}
+
+// fetch replaces the keys with the ones of the fetcher and closes done. The fetch is detached from the
+// request that started it, so its cancellation doesn't fail the other requests waiting for the keys.
+func (c *CachedKeySet) fetch(ctx context.Context, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.fetchTimeout)
+	defer cancel()
+
+	var keys map[string]ed25519.PublicKey
+	keySet, err := c.fetcher.FetchKeys(ctx)
+	if err == nil {
+		keys, err = parseKeySet(keySet)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		log.Printf("failed to fetch token keys: %v", err)
+		c.fetchErr = err
+	} else {
+		c.keys = keys
+		c.fetchedAt = time.Now()
+		c.fetchErr = nil
+	}
+	c.fetching = nil
+	close(done)
+}
+
+// cached returns a cached key, which may be expired if the keys can't be fetched currently.
+func (c *CachedKeySet) cached(keyID string) (ed25519.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, known := c.keys[keyID]; known {
+		return key, nil
+	}
+	if c.fetchedAt.IsZero() {
+		return nil, fmt.Errorf("%w: %v", ErrKeysUnavailable, c.fetchErr)
+	}
+
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, keyID)
+}
+
+// parseKeySet returns the Ed25519 signing keys of keySet by key ID and skips other keys.
+func parseKeySet(keySet *JSONWebKeySet) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid key %q in key set", jwk.KeyID)
+		}
+		keys[jwk.KeyID] = ed25519.PublicKey(x)
+	}
+
+	return keys, nil
+}
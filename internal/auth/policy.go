@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"fmt"
+
+	"go-microservices-observability/internal/errs"
+)
+
+// The scopes granted to users.
+const (
+	ScopeOrdersRead  = "orders:read"
+	ScopeOrdersWrite = "orders:write"
+	ScopeAdmin       = "admin"
+)
+
+// ErrForbidden is returned if a principal is not allowed to perform an operation.
+var ErrForbidden = errs.New(errs.ErrForbidden, "forbidden")
+
+// Policy decides whether a principal is allowed to perform an operation.
+type Policy struct {
+	// Name identifies the policy in audits, e.g. the span attributes of a request.
+	Name string
+	// Scopes are the scopes a principal needs, all of them.
+	Scopes []string
+}
+
+// RequireScope returns a policy that allows principals with scope and is named after it.
+func RequireScope(scope string) Policy {
+	return Policy{
+		Name:   scope,
+		Scopes: []string{scope},
+	}
+}
+
+// Authorize returns an error wrapping ErrForbidden if the policy doesn't allow principal.
+func (p Policy) Authorize(principal Principal) error {
+	for _, scope := range p.Scopes {
+		if !principal.HasScope(scope) {
+			return fmt.Errorf("%w: missing scope %s", ErrForbidden, scope)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"go-microservices-observability/internal/errs"
+)
+
+func TestPolicy_Authorize(t *testing.T) {
+	t.Parallel()
+
+	policy := RequireScope(ScopeOrdersWrite)
+	if policy.Name != ScopeOrdersWrite {
+		t.Fatalf("expected the policy to be named %s, got %s", ScopeOrdersWrite, policy.Name)
+	}
+
+	tests := []struct {
+		scopes  []string
+		allowed bool
+	}{
+		{[]string{ScopeOrdersRead, ScopeOrdersWrite}, true},
+		{[]string{ScopeOrdersRead}, false},
+		{[]string{ScopeAdmin}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		err := policy.Authorize(Principal{Subject: "alice", Scopes: tt.scopes})
+		if tt.allowed && err != nil {
+			t.Errorf("%v: expected to be allowed, got %v", tt.scopes, err)
+		}
+		if !tt.allowed && (!errors.Is(err, ErrForbidden) || !errors.Is(err, errs.ErrForbidden)) {
+			t.Errorf("%v: expected %v, got %v", tt.scopes, ErrForbidden, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Package auth carries the authenticated caller of a request through its context.
+package auth
+
+import (
+	"context"
+	"slices"
+
+	"go-microservices-observability/internal/errs"
+)
+
+// ErrUnauthenticated is returned by operations that require a principal if the context has none.
+var ErrUnauthenticated = errs.New(errs.ErrUnauthorized, "not authenticated")
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Subject identifies the caller, e.g. the username.
+	Subject string
+	// Scopes are the permissions granted to the caller, e.g. orders:read.
+	Scopes []string
+}
+
+// HasScope reports whether scope is granted to the principal.
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx that carries principal.
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal carried by ctx.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
+
+// RequirePrincipal returns the principal carried by ctx or ErrUnauthenticated.
+func RequirePrincipal(ctx context.Context) (Principal, error) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || principal.Subject == "" {
+		return Principal{}, ErrUnauthenticated
+	}
+
+	return principal, nil
+}
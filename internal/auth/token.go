@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go-microservices-observability/internal/errs"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidToken is returned for tokens that are malformed, expired or not signed by a key of the issuer.
+var ErrInvalidToken = errs.New(errs.ErrUnauthorized, "invalid token")
+
+// Claims are the claims of an access token.
+type Claims struct {
+	jwt.RegisteredClaims
+	// Scope is the space-separated list of the scopes granted to the subject.
+	Scope string `json:"scope,omitempty"`
+}
+
+// JSONWebKey is the public key of a signer as a JSON Web Key (RFC 8037).
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// JSONWebKeySet is the set of keys that tokens of an issuer are signed with, served as the JWKS of the issuer.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Signer issues access tokens signed with an Ed25519 key.
+type Signer struct {
+	issuer string
+	keyID  string
+	key    ed25519.PrivateKey
+}
+
+// NewSigner creates a signer for issuer with a new random key. The tokens it issues are only accepted while
+// its key is published, i.e. until the signer is replaced by a restart.
+func NewSigner(issuer string) (*Signer, error) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	thumbprint := sha256.Sum256(publicKey)
+
+	return &Signer{
+		issuer: issuer,
+		keyID:  base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+		key:    key,
+	}, nil
+}
+
+// Sign issues a token for principal that expires after ttl.
+func (s *Signer) Sign(principal Principal, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    s.issuer,
+			Subject:   principal.Subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		Scope: strings.Join(principal.Scopes, " "),
+	})
+	token.Header["kid"] = s.keyID
+
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	return signed, expiresAt, nil
+}
+
+// KeySet returns the public key of the signer.
+func (s *Signer) KeySet() JSONWebKeySet {
+	return JSONWebKeySet{
+		Keys: []JSONWebKey{
+			{
+				KeyType:   "OKP",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+				KeyID:     s.keyID,
+				Algorithm: jwt.SigningMethodEdDSA.Alg(),
+				Use:       "sig",
+			},
+		},
+	}
+}
+
+// KeySource looks up the public key that tokens with the given key ID are signed with.
+type KeySource interface {
+	Key(ctx context.Context, keyID string) (ed25519.PublicKey, error)
+}
+
+// Verifier validates the access tokens of an issuer locally against its public keys.
+type Verifier struct {
+	keys   KeySource
+	issuer string
+}
+
+func NewVerifier(keys KeySource, issuer string) *Verifier {
+	return &Verifier{
+		keys:   keys,
+		issuer: issuer,
+	}
+}
+
+// Verify validates the signature, issuer and lifetime of token and returns its principal. It returns an
+// error wrapping ErrInvalidToken if the token is rejected, or the error of the KeySource if the keys are
+// not available.
+func (v *Verifier) Verify(ctx context.Context, token string) (Principal, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(
+		token,
+		&claims,
+		func(token *jwt.Token) (any, error) {
+			keyID, _ := token.Header["kid"].(string)
+			return v.keys.Key(ctx, keyID)
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if errors.Is(err, errs.ErrUnavailable) {
+		return Principal{}, err
+	}
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if claims.Subject == "" {
+		return Principal{}, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+
+	return Principal{
+		Subject: claims.Subject,
+		Scopes:  strings.Fields(claims.Scope),
+	}, nil
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-microservices-observability/internal/errs"
+)
+
+type fetcherFunc func(ctx context.Context) (*JSONWebKeySet, error)
+
+func (f fetcherFunc) FetchKeys(ctx context.Context) (*JSONWebKeySet, error) {
+	return f(ctx)
+}
+
+func newTestSigner(t *testing.T, issuer string) *Signer {
+	t.Helper()
+
+	signer, err := NewSigner(issuer)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	return signer
+}
+
+func sign(t *testing.T, signer *Signer, principal Principal, ttl time.Duration) string {
+	t.Helper()
+
+	token, _, err := signer.Sign(principal, ttl)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	return token
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	signer := newTestSigner(t, "user-service")
+	verifier := NewVerifier(NewCachedKeySet(fetcherFunc(func(ctx context.Context) (*JSONWebKeySet, error) {
+		keySet := signer.KeySet()
+		return &keySet, nil
+	}), nil), "user-service")
+
+	principal := Principal{Subject: "alice", Scopes: []string{"orders:read", "orders:write"}}
+	got, err := verifier.Verify(ctx, sign(t, signer, principal, time.Minute))
+	if err != nil {
+		t.Fatalf("failed to verify token: %v", err)
+	}
+	if got.Subject != principal.Subject || !slices.Equal(got.Scopes, principal.Scopes) {
+		t.Fatalf("expected principal %+v, got %+v", principal, got)
+	}
+
+	rejected := map[string]string{
+		"malformed":      "not-a-token",
+		"expired":        sign(t, signer, principal, -time.Minute),
+		"other issuer":   sign(t, newTestSigner(t, "other-service"), principal, time.Minute),
+		"unknown key":    sign(t, newTestSigner(t, "user-service"), principal, time.Minute),
+		"missing scheme": "Bearer " + sign(t, signer, principal, time.Minute),
+	}
+	for name, token := range rejected {
+		if _, err := verifier.Verify(ctx, token); !errors.Is(err, ErrInvalidToken) || !errors.Is(err, errs.ErrUnauthorized) {
+			t.Errorf("%s: expected %v, got %v", name, ErrInvalidToken, err)
+		}
+	}
+
+	// Tokens can't be told valid or invalid without the keys, also within the refresh interval.
+	unavailable := NewVerifier(NewCachedKeySet(fetcherFunc(func(ctx context.Context) (*JSONWebKeySet, error) {
+		return nil, errs.New(errs.ErrUnavailable, "user service unavailable")
+	}), nil), "user-service")
+	for range 2 {
+		_, err := unavailable.Verify(ctx, sign(t, signer, principal, time.Minute))
+		if !errors.Is(err, ErrKeysUnavailable) || !errors.Is(err, errs.ErrUnavailable) {
+			t.Fatalf("expected %v, got %v", ErrKeysUnavailable, err)
+		}
+	}
+}
+
+func TestCachedKeySet_KeyFetchesOnce(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestSigner(t, "user-service")
+	keyID := signer.KeySet().Keys[0].KeyID
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	keys := NewCachedKeySet(fetcherFunc(func(ctx context.Context) (*JSONWebKeySet, error) {
+		fetches.Add(1)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		keySet := signer.KeySet()
+		return &keySet, nil
+	}), nil)
+
+	// The request that starts the fetch gives up, the others still get the keys of its fetch.
+	cancelled, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := keys.Key(cancelled, keyID)
+		first <- err
+	}()
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan error, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.Key(context.Background(), keyID)
+			results <- err
+		}()
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for err := range results {
+		if err != nil {
+			t.Fatalf("failed to get key: %v", err)
+		}
+	}
+	if fetches.Load() != 1 {
+		t.Fatalf("expected the keys to be fetched once, got %d fetches", fetches.Load())
+	}
+}
+
+func TestCachedKeySet_Key(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	signer := newTestSigner(t, "user-service")
+	keyID := signer.KeySet().Keys[0].KeyID
+
+	var fetches int
+	var fetchErr error
+	keys := NewCachedKeySet(fetcherFunc(func(ctx context.Context) (*JSONWebKeySet, error) {
+		fetches++
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+
+		keySet := signer.KeySet()
+		return &keySet, nil
+	}), &CachedKeySetConfig{TTL: time.Hour, MinRefreshInterval: time.Hour})
+
+	for range 3 {
+		if _, err := keys.Key(ctx, keyID); err != nil {
+			t.Fatalf("failed to get key: %v", err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected the keys to be fetched once, got %d fetches", fetches)
+	}
+
+	// Unknown keys don't fetch the keys again within the refresh interval.
+	for range 3 {
+		if _, err := keys.Key(ctx, "unknown"); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("expected %v, got %v", ErrInvalidToken, err)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("expected the keys to be fetched once, got %d fetches", fetches)
+	}
+
+	// The expired keys are used while the issuer is unavailable.
+	keys.fetchedAt = time.Now().Add(-2 * time.Hour)
+	keys.attemptedAt = keys.fetchedAt
+	fetchErr = errs.New(errs.ErrUnavailable, "user service unavailable")
+	if _, err := keys.Key(ctx, keyID); err != nil {
+		t.Fatalf("expected the expired key, got %v", err)
+	}
+	if _, err := keys.Key(ctx, "unknown"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected %v, got %v", ErrInvalidToken, err)
+	}
+	if fetches != 2 {
+		t.Fatalf("expected the keys to be fetched twice, got %d fetches", fetches)
+	}
+}
@@ -1,12 +1,35 @@
 package domain
 
+// OrderStatus is the state of an order in its lifecycle.
+type OrderStatus string
+
+const (
+	// OrderStatusPending is the initial state until the inventory has answered.
+	OrderStatusPending OrderStatus = "PENDING"
+	// OrderStatusReserved means all items are reserved in the inventory.
+	OrderStatusReserved OrderStatus = "RESERVED"
+	// OrderStatusConfirmed means the reserved items are finally deducted from the inventory.
+	OrderStatusConfirmed OrderStatus = "CONFIRMED"
+	// OrderStatusRejected means the inventory could not reserve the items.
+	OrderStatusRejected OrderStatus = "REJECTED"
+	// OrderStatusCancelled means the order was cancelled and its reserved items are released.
+	OrderStatusCancelled OrderStatus = "CANCELLED"
+)
+
 type Order struct {
-	ID         string   `json:"id"`
-	CustomerID string   `json:"customerId"`
-	ProductIDs []string `json:"productIds"`
+	ID           string      `json:"id"`
+	CustomerID   string      `json:"customerId"`
+	ProductIDs   []string    `json:"productIds"`
+	Status       OrderStatus `json:"status"`
+	StatusReason string      `json:"statusReason,omitempty"`
 }
 
 type Product struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+	Reserved int    `json:"reserved"`
+	// Version is incremented on every change of the product. An update has to name the version it is
+	// based on and fails if the product was changed in the meantime.
+	Version int `json:"version"`
 }
@@ -0,0 +1,15 @@
+package domain
+
+import "time"
+
+type User struct {
+	Username string `json:"username"`
+	// PasswordHash is the bcrypt hash of the password, it never leaves the user service.
+	PasswordHash []byte `json:"-"`
+	// Scopes are the permissions of the user, which are granted to their tokens.
+	Scopes []string `json:"scopes"`
+	// FailedAttempts counts the failed authentications since the last successful one or the last lockout.
+	FailedAttempts int       `json:"-"`
+	LockedUntil    time.Time `json:"-"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
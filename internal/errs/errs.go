@@ -0,0 +1,85 @@
+// Package errs defines the kinds of errors shared by the repositories, services and adapters. Every
+// error of a kind wraps it, so callers check the kind with errors.Is instead of knowing the specific
+// errors of every component, e.g. to map them to HTTP status codes.
+package errs
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrNotFound means the requested entity doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists means an entity with the same identity exists already.
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrConflict means the request conflicts with the current state of an entity, e.g. a stale version.
+	ErrConflict = errors.New("conflict")
+	// ErrValidation means the request is invalid and must not be repeated unchanged.
+	ErrValidation = errors.New("validation failed")
+	// ErrUnauthorized means the caller could not be authenticated.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden means the authenticated caller is not allowed to perform the request.
+	ErrForbidden = errors.New("forbidden")
+	// ErrUnavailable means a dependency is unavailable, the request may succeed later.
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// New returns an error with the given message that is of the given kind, e.g.
+//
+//	var ErrOrderNotFound = errs.New(errs.ErrNotFound, "order not found")
+func New(kind error, message string) error {
+	return &kindError{kind: kind, message: message}
+}
+
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// FieldError describes why a field of a request is invalid.
+type FieldError struct {
+	// Field is the name of the field in the request, e.g. productIds[1].
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is an ErrValidation that lists the invalid fields of a request.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+// Add records an invalid field.
+func (e *ValidationError) Add(field string, message string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+}
+
+// Err returns e if any field is invalid, otherwise nil.
+func (e *ValidationError) Err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		fields = append(fields, field.Field+" "+field.Message)
+	}
+
+	return ErrValidation.Error() + ": " + strings.Join(fields, ", ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
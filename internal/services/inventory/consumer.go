@@ -3,56 +3,155 @@ package inventory
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go-microservices-observability/internal/adapters/queue"
+	inventoryRepo "go-microservices-observability/internal/adapters/repository/inventory"
 	"go-microservices-observability/pkg/tracing"
 )
 
-const DeductItemsTopic = "deduct-items"
+const (
+	DeductItemsTopic    = "deduct-items"
+	CommitItemsTopic    = "commit-items"
+	ReleaseItemsTopic   = "release-items"
+	InventoryReplyTopic = "inventory-replies"
+)
+
+// ReplyType is the outcome of an inventory command, sent back to the order service.
+type ReplyType string
+
+const (
+	ReplyItemsReserved  ReplyType = "ITEMS_RESERVED"
+	ReplyItemsRejected  ReplyType = "ITEMS_REJECTED"
+	ReplyItemsCommitted ReplyType = "ITEMS_COMMITTED"
+	ReplyItemsReleased  ReplyType = "ITEMS_RELEASED"
+)
 
 // DeductItemsMessage defines the structure of the message for deducting items.
 type DeductItemsMessage struct {
-	ProductIDs  []string            `json:"productIds"`
-	SpanContext tracing.SpanContext `json:"spanContext"`
+	OrderID    string   `json:"orderId"`
+	ProductIDs []string `json:"productIds"`
+}
+
+// ReservationMessage defines the structure of the message for committing or releasing the reserved
+// items of an order.
+type ReservationMessage struct {
+	OrderID string `json:"orderId"`
+}
+
+// ReplyMessage defines the structure of the message the inventory answers a command with.
+type ReplyMessage struct {
+	OrderID string    `json:"orderId"`
+	Type    ReplyType `json:"type"`
+	Reason  string    `json:"reason,omitempty"`
 }
 
-// NewDeductItemsHandler creates a new handler for deducting items from inventory.
-func NewDeductItemsHandler(service Service, tracer tracing.Tracer) func(message []byte) error {
-	return func(message []byte) error {
+// NewDeductItemsHandler creates a new handler for deducting items from inventory. The items are
+// reserved and the outcome is replied to the order service.
+func NewDeductItemsHandler(service Service, tracer tracing.Tracer, queueClient queue.Queue) queue.Handler {
+	return func(ctx context.Context, message []byte) error {
 		var deductItemsMessage DeductItemsMessage
 		if err := json.Unmarshal(message, &deductItemsMessage); err != nil {
 			return fmt.Errorf("failed to unmarshal message: %w", err)
 		}
 
-		ctx := context.Background()
-
-		ctx, span := tracer.StartSpanWithContext(
-			ctx,
-			"internal.services.inventory.consumer.DeductItems",
-			deductItemsMessage.SpanContext.SpanContext,
-		)
+		ctx, span := tracer.Start(ctx, "internal.services.inventory.consumer.DeductItems")
 		defer span.End()
 
 		println("DeductItemsMessage: ", fmt.Sprintf("%+v", deductItemsMessage))
 
-		// Deduct each product.
+		// Every occurrence of a product ID in the order is one unit of that product.
+		quantities := make(map[string]int)
 		for _, productID := range deductItemsMessage.ProductIDs {
-			product, err := service.Get(ctx, productID)
-			if err != nil {
-				fmt.Printf("Error getting product %s: %v\n", productID, err)
-				continue // Continue to the next product.
-			}
-
-			// For now, just delete the product.  In a real system, you'd likely
-			// update a quantity or status field.
-			err = service.Delete(ctx, productID)
-			if err != nil {
-				fmt.Printf("Error deleting product %s: %v\n", productID, err)
-				// Consider whether to continue or return an error based on your requirements.
-				return err
-			}
-			fmt.Printf("Product %s deducted (deleted) from inventory.\n", product.Name)
-		}
-
-		return nil
+			quantities[productID]++
+		}
+
+		// Reserve all items at once, so that an order is either fully reserved or rejected.
+		reply := ReplyMessage{
+			OrderID: deductItemsMessage.OrderID,
+			Type:    ReplyItemsReserved,
+		}
+		err := service.Reserve(ctx, deductItemsMessage.OrderID, quantities)
+		if errors.Is(err, inventoryRepo.ErrVersionConflict) {
+			// The repositories reserve in a single transaction, so this only guards a repository that
+			// doesn't. The stock is still unknown, so the order is neither reserved nor rejected yet.
+			return err
+		}
+		// A redelivered message finds its reservation already in place.
+		if err != nil && !errors.Is(err, inventoryRepo.ErrReservationAlreadyExists) {
+			fmt.Printf("Order %s rejected: %v\n", deductItemsMessage.OrderID, err)
+			reply.Type = ReplyItemsRejected
+			reply.Reason = err.Error()
+		}
+
+		return queueClient.Publish(ctx, InventoryReplyTopic, reply)
+	}
+}
+
+// NewCommitItemsHandler creates a new handler for finally deducting the reserved items of an order.
+func NewCommitItemsHandler(service Service, tracer tracing.Tracer, queueClient queue.Queue) queue.Handler {
+	return func(ctx context.Context, message []byte) error {
+		var reservationMessage ReservationMessage
+		if err := json.Unmarshal(message, &reservationMessage); err != nil {
+			return fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+
+		ctx, span := tracer.Start(ctx, "internal.services.inventory.consumer.CommitItems")
+		defer span.End()
+
+		err := service.Commit(ctx, reservationMessage.OrderID)
+		if errors.Is(err, inventoryRepo.ErrReservationCommitted) {
+			// Committed by an earlier delivery of this message, whose reply might have been lost.
+			err = nil
+		}
+		if err != nil {
+			fmt.Printf("Error committing reservation of order %s: %v\n", reservationMessage.OrderID, err)
+			return err
+		}
+
+		fmt.Printf("Items of order %s deducted from inventory.\n", reservationMessage.OrderID)
+
+		return queueClient.Publish(ctx, InventoryReplyTopic, ReplyMessage{
+			OrderID: reservationMessage.OrderID,
+			Type:    ReplyItemsCommitted,
+		})
+	}
+}
+
+// NewReleaseItemsHandler creates a new handler that compensates a reservation by giving the reserved
+// items of an order back to the inventory.
+func NewReleaseItemsHandler(service Service, tracer tracing.Tracer, queueClient queue.Queue) queue.Handler {
+	return func(ctx context.Context, message []byte) error {
+		var reservationMessage ReservationMessage
+		if err := json.Unmarshal(message, &reservationMessage); err != nil {
+			return fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+
+		ctx, span := tracer.Start(ctx, "internal.services.inventory.consumer.ReleaseItems")
+		defer span.End()
+
+		err := service.Release(ctx, reservationMessage.OrderID)
+		// The items were never reserved or are released already by an earlier delivery of this message.
+		if errors.Is(err, inventoryRepo.ErrReservationNotFound) ||
+			errors.Is(err, inventoryRepo.ErrReservationReleased) {
+			return nil
+		}
+		if errors.Is(err, inventoryRepo.ErrReservationCommitted) {
+			// The items are deducted for good and can't be given back. The message is dead-lettered for an
+			// operator rather than acknowledged as if the items were released.
+			fmt.Printf("Reservation of order %s can't be released: %v\n", reservationMessage.OrderID, err)
+			return err
+		}
+		if err != nil {
+			fmt.Printf("Error releasing reservation of order %s: %v\n", reservationMessage.OrderID, err)
+			return err
+		}
+
+		fmt.Printf("Items of order %s released to inventory.\n", reservationMessage.OrderID)
+
+		return queueClient.Publish(ctx, InventoryReplyTopic, ReplyMessage{
+			OrderID: reservationMessage.OrderID,
+			Type:    ReplyItemsReleased,
+		})
 	}
 }
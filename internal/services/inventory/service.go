@@ -13,6 +13,9 @@ type Service interface {
 	Create(ctx context.Context, product *domain.Product) error
 	Update(ctx context.Context, product *domain.Product) error
 	Delete(ctx context.Context, id string) error
+	Reserve(ctx context.Context, reservationID string, quantities map[string]int) error
+	Release(ctx context.Context, reservationID string) error
+	Commit(ctx context.Context, reservationID string) error
 }
 
 type service struct {
@@ -58,3 +61,24 @@ func (s *service) Delete(ctx context.Context, id string) error {
 
 	return s.repo.Delete(ctx, id)
 }
+
+func (s *service) Reserve(ctx context.Context, reservationID string, quantities map[string]int) error {
+	ctx, span := s.tracer.Start(ctx, "internal.services.inventory.Reserve")
+	defer span.End()
+
+	return s.repo.Reserve(ctx, reservationID, quantities)
+}
+
+func (s *service) Release(ctx context.Context, reservationID string) error {
+	ctx, span := s.tracer.Start(ctx, "internal.services.inventory.Release")
+	defer span.End()
+
+	return s.repo.Release(ctx, reservationID)
+}
+
+func (s *service) Commit(ctx context.Context, reservationID string) error {
+	ctx, span := s.tracer.Start(ctx, "internal.services.inventory.Commit")
+	defer span.End()
+
+	return s.repo.Commit(ctx, reservationID)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"go-microservices-observability/internal/adapters/queue"
 	"go-microservices-observability/pkg/tracing"
 )
 
@@ -11,25 +12,18 @@ const SendNotificationTopic = "send-notification"
 
 // SendNotificationMessage defines the structure of the message for sending notifications.
 type SendNotificationMessage struct {
-	UserID      string              `json:"userId"`
-	SpanContext tracing.SpanContext `json:"spanContext"`
+	UserID string `json:"userId"`
 }
 
 // NewSendNotificationHandler creates a new handler for sending notifications.
-func NewSendNotificationHandler(service Service, tracer tracing.Tracer) func(message []byte) error {
-	return func(message []byte) error {
+func NewSendNotificationHandler(service Service, tracer tracing.Tracer) queue.Handler {
+	return func(ctx context.Context, message []byte) error {
 		var sendNotificationMessage SendNotificationMessage
 		if err := json.Unmarshal(message, &sendNotificationMessage); err != nil {
 			return fmt.Errorf("failed to unmarshal message: %w", err)
 		}
 
-		ctx := context.Background()
-
-		ctx, span := tracer.StartSpanWithContext(
-			ctx,
-			"internal.services.notification.consumer.SendNotification",
-			sendNotificationMessage.SpanContext.SpanContext,
-		)
+		ctx, span := tracer.Start(ctx, "internal.services.notification.consumer.SendNotification")
 		defer span.End()
 
 		println("SendNotificationMessage: ", fmt.Sprintf("%+v", sendNotificationMessage))
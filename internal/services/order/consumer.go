@@ -0,0 +1,31 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-microservices-observability/internal/adapters/queue"
+	"go-microservices-observability/internal/services/inventory"
+	"go-microservices-observability/pkg/tracing"
+)
+
+// NewInventoryReplyHandler creates a new handler that advances the order saga with the replies of the
+// inventory.
+func NewInventoryReplyHandler(service Service, tracer tracing.Tracer) queue.Handler {
+	return func(ctx context.Context, message []byte) error {
+		var replyMessage inventory.ReplyMessage
+		if err := json.Unmarshal(message, &replyMessage); err != nil {
+			return fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+
+		ctx, span := tracer.Start(ctx, "internal.services.order.consumer.InventoryReply")
+		defer span.End()
+
+		if err := service.HandleInventoryReply(ctx, replyMessage); err != nil {
+			fmt.Printf("Error handling inventory reply for order %s: %v\n", replyMessage.OrderID, err)
+			return err
+		}
+
+		return nil
+	}
+}
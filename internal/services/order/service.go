@@ -3,108 +3,240 @@ package order
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"go-microservices-observability/internal/adapters/queue"
 	orderRepo "go-microservices-observability/internal/adapters/repository/order"
+	"go-microservices-observability/internal/auth"
 	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
 	"go-microservices-observability/internal/services/inventory"
 	"go-microservices-observability/internal/services/notification"
 	"go-microservices-observability/pkg/tracing"
-	"time"
+	"slices"
+	"sync"
 
 	"github.com/google/uuid"
 )
 
+var ErrInvalidStatusTransition = errs.New(errs.ErrConflict, "invalid order status transition")
+
+// ErrItemsChanged is returned if an update changes the items of an order, which the inventory reserves as
+// they were when the order was created.
+var ErrItemsChanged = errs.New(errs.ErrConflict, "items of order can't be changed")
+
+// Service manages the orders of customers. Create, Get, Update, Delete, List and Cancel act on behalf of
+// the auth.Principal in ctx, which is the customer of the orders. Orders of other customers are not found.
 type Service interface {
 	Create(ctx context.Context, order *domain.Order) error
 	Get(ctx context.Context, id string) (*domain.Order, error)
+	// Update stores an order with the same items, which are reserved as they were created in every status.
+	// Changed items are rejected with ErrItemsChanged, the order has to be cancelled and created again.
 	Update(ctx context.Context, order *domain.Order) error
+	// Delete deletes an order once its saga is finished, i.e. it is confirmed, rejected or cancelled.
 	Delete(ctx context.Context, id string) error
 	List(ctx context.Context) ([]*domain.Order, error)
-	Shutdown()
+	// Cancel cancels a pending order. Items that are reserved for it afterwards are released.
+	Cancel(ctx context.Context, id string) (*domain.Order, error)
+	// HandleInventoryReply advances the order saga with the reply of the inventory.
+	HandleInventoryReply(ctx context.Context, reply inventory.ReplyMessage) error
+	// CompactOutbox deletes the processed and failed outbox messages according to the retention policy and
+	// returns their number.
+	CompactOutbox(ctx context.Context) (int, error)
+	// Shutdown stops the outbox worker after it published the pending messages.
+	Shutdown(ctx context.Context) error
+}
+
+// ProductCatalog looks up the products of orders. It is implemented by inventory.Service.
+type ProductCatalog interface {
+	Get(ctx context.Context, id string) (*domain.Product, error)
 }
 
 type service struct {
 	repo        orderRepo.Repository
 	tracer      tracing.Tracer
 	queueClient queue.Queue
+	products    ProductCatalog
 	worker      *orderRepo.OutboxWorker
+	// statusMu serializes status transitions of the saga.
+	statusMu sync.Mutex
 }
 
-func NewService(repo orderRepo.Repository, tracer tracing.Tracer, queueClient queue.Queue) Service {
-	worker := orderRepo.NewOutboxWorker(repo, queueClient, 1*time.Second)
+func NewService(
+	repo orderRepo.Repository,
+	tracer tracing.Tracer,
+	queueClient queue.Queue,
+	products ProductCatalog,
+) Service {
+	worker := orderRepo.NewOutboxWorker(repo, queueClient, &orderRepo.OutboxWorkerConfig{
+		Tracer: tracer,
+	})
 	worker.Start()
 
 	return &service{
 		repo:        repo,
 		tracer:      tracer,
 		queueClient: queueClient,
+		products:    products,
 		worker:      worker,
 	}
 }
 
+// Create validates the order and stores it with a new ID for the customer in ctx.
 func (s *service) Create(ctx context.Context, order *domain.Order) error {
 	ctx, span := s.tracer.Start(ctx, "internal.services.order.Create")
 	defer span.End()
 
-	err := s.repo.Create(ctx, order)
+	principal, err := auth.RequirePrincipal(ctx)
 	if err != nil {
 		return err
 	}
+	order.CustomerID = principal.Subject
 
-	// Create inventory deduction message
-	deductItemsMsg := inventory.DeductItemsMessage{
-		ProductIDs:  order.ProductIDs,
-		SpanContext: tracing.NewSpanContext(span.SpanContext()),
-	}
-	deductItemsBytes, err := json.Marshal(deductItemsMsg)
-	if err != nil {
+	if err := s.validate(ctx, order); err != nil {
 		return err
 	}
 
-	// Store inventory message in outbox
-	err = s.repo.StoreOutboxMessage(ctx, &orderRepo.OutboxMessage{
-		ID:      uuid.New().String(),
-		Topic:   inventory.DeductItemsTopic,
-		Message: deductItemsBytes,
+	order.ID = uuid.New().String()
+	order.Status = domain.OrderStatusPending
+	order.StatusReason = ""
+
+	// The order and its messages are stored atomically, so no message is lost or sent for a missing order.
+	return s.repo.WithinTx(ctx, func(tx orderRepo.Repository) error {
+		if err := tx.Create(ctx, order); err != nil {
+			return err
+		}
+
+		// Create inventory deduction message
+		deductItemsMsg := inventory.DeductItemsMessage{
+			OrderID:    order.ID,
+			ProductIDs: order.ProductIDs,
+		}
+		deductItemsBytes, err := json.Marshal(deductItemsMsg)
+		if err != nil {
+			return err
+		}
+
+		// Store inventory message in outbox
+		err = tx.StoreOutboxMessage(ctx, &orderRepo.OutboxMessage{
+			ID:      uuid.New().String(),
+			Topic:   inventory.DeductItemsTopic,
+			Message: deductItemsBytes,
+			Headers: traceHeaders(ctx),
+		})
+		if err != nil {
+			return err
+		}
+
+		// Create notification message
+		notificationMsg := notification.SendNotificationMessage{
+			UserID: order.CustomerID,
+		}
+		notificationBytes, err := json.Marshal(notificationMsg)
+		if err != nil {
+			return err
+		}
+
+		// Store notification message in outbox
+		return tx.StoreOutboxMessage(ctx, &orderRepo.OutboxMessage{
+			ID:      uuid.New().String(),
+			Topic:   notification.SendNotificationTopic,
+			Message: notificationBytes,
+			Headers: traceHeaders(ctx),
+		})
 	})
-	if err != nil {
-		return err
-	}
+}
 
-	// Create notification message
-	notificationMsg := notification.SendNotificationMessage{
-		UserID:      "test",
-		SpanContext: tracing.NewSpanContext(span.SpanContext()),
+// validate returns an *errs.ValidationError if the order has no customer or products, or refers to
+// products that don't exist.
+func (s *service) validate(ctx context.Context, order *domain.Order) error {
+	var validationErr errs.ValidationError
+	if order.CustomerID == "" {
+		validationErr.Add("customerId", "is required")
 	}
-	notificationBytes, err := json.Marshal(notificationMsg)
-	if err != nil {
-		return err
+	if len(order.ProductIDs) == 0 {
+		validationErr.Add("productIds", "must contain at least one product")
 	}
 
-	// Store notification message in outbox
-	err = s.repo.StoreOutboxMessage(ctx, &orderRepo.OutboxMessage{
-		ID:      uuid.New().String(),
-		Topic:   notification.SendNotificationTopic,
-		Message: notificationBytes,
-	})
-	if err != nil {
-		return err
+	checked := make(map[string]error)
+	for i, productID := range order.ProductIDs {
+		field := fmt.Sprintf("productIds[%d]", i)
+		if productID == "" {
+			validationErr.Add(field, "is required")
+			continue
+		}
+
+		err, exists := checked[productID]
+		if !exists {
+			_, err = s.products.Get(ctx, productID)
+			checked[productID] = err
+		}
+		if errors.Is(err, errs.ErrNotFound) {
+			validationErr.Add(field, "refers to unknown product "+productID)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to look up product %s: %w", productID, err)
+		}
 	}
 
-	return nil
+	return validationErr.Err()
 }
 
 func (s *service) Get(ctx context.Context, id string) (*domain.Order, error) {
 	ctx, span := s.tracer.Start(ctx, "internal.services.order.Get")
 	defer span.End()
 
-	return s.repo.Get(ctx, id)
+	return s.getOwned(ctx, id)
+}
+
+// getOwned returns the order if it belongs to the customer in ctx, otherwise orderRepo.ErrOrderNotFound.
+// Orders of other customers are not found rather than forbidden, so their IDs can't be probed.
+func (s *service) getOwned(ctx context.Context, id string) (*domain.Order, error) {
+	principal, err := auth.RequirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.CustomerID != principal.Subject {
+		return nil, orderRepo.ErrOrderNotFound
+	}
+
+	return order, nil
 }
 
 func (s *service) Update(ctx context.Context, order *domain.Order) error {
 	ctx, span := s.tracer.Start(ctx, "internal.services.order.Update")
 	defer span.End()
 
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	stored, err := s.getOwned(ctx, order.ID)
+	if err != nil {
+		return err
+	}
+
+	// The customer can't be changed, the status is owned by the saga.
+	order.CustomerID = stored.CustomerID
+	order.Status = stored.Status
+	order.StatusReason = stored.StatusReason
+
+	if err := s.validate(ctx, order); err != nil {
+		return err
+	}
+
+	// The deduct-items message with the items is stored along with the order, so even the reservation of a
+	// pending order would no longer match its items.
+	if !slices.Equal(order.ProductIDs, stored.ProductIDs) {
+		return ErrItemsChanged
+	}
+
 	return s.repo.Update(ctx, order)
 }
 
@@ -112,6 +244,21 @@ func (s *service) Delete(ctx context.Context, id string) error {
 	ctx, span := s.tracer.Start(ctx, "internal.services.order.Delete")
 	defer span.End()
 
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	order, err := s.getOwned(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// The inventory still acts on the items of an unfinished order, e.g. commits its reservation.
+	if order.Status != domain.OrderStatusConfirmed &&
+		order.Status != domain.OrderStatusRejected &&
+		order.Status != domain.OrderStatusCancelled {
+		return fmt.Errorf("%w: can't delete order in status %s", ErrInvalidStatusTransition, order.Status)
+	}
+
 	return s.repo.Delete(ctx, id)
 }
 
@@ -119,11 +266,149 @@ func (s *service) List(ctx context.Context) ([]*domain.Order, error) {
 	ctx, span := s.tracer.Start(ctx, "internal.services.order.List")
 	defer span.End()
 
-	return s.repo.List(ctx)
+	principal, err := auth.RequirePrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repo.List(ctx, principal.Subject)
+}
+
+func (s *service) Cancel(ctx context.Context, id string) (*domain.Order, error) {
+	ctx, span := s.tracer.Start(ctx, "internal.services.order.Cancel")
+	defer span.End()
+
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	order, err := s.getOwned(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The reservation of a reserved order is committed already in the outbox, releasing it would race the
+	// commit.
+	if order.Status != domain.OrderStatusPending {
+		return nil, fmt.Errorf("%w: can't cancel order in status %s", ErrInvalidStatusTransition, order.Status)
+	}
+
+	// Items that are reserved afterwards are released once the reply arrives.
+	return s.setStatus(ctx, s.repo, order, domain.OrderStatusCancelled, "cancelled by customer")
 }
 
-func (s *service) Shutdown() {
-	if s.worker != nil {
-		s.worker.Stop()
+func (s *service) HandleInventoryReply(ctx context.Context, reply inventory.ReplyMessage) error {
+	ctx, span := s.tracer.Start(ctx, "internal.services.order.HandleInventoryReply")
+	defer span.End()
+
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	order, err := s.repo.Get(ctx, reply.OrderID)
+	if err != nil && !errors.Is(err, orderRepo.ErrOrderNotFound) {
+		return err
+	}
+
+	switch reply.Type {
+	case inventory.ReplyItemsReserved:
+		// Nobody is waiting for the items anymore, so compensate the reservation.
+		if order == nil || order.Status == domain.OrderStatusCancelled || order.Status == domain.OrderStatusRejected {
+			return s.storeReservationMessage(ctx, s.repo, inventory.ReleaseItemsTopic, reply.OrderID)
+		}
+		// A redelivered reply of a reservation that is committed already or being committed.
+		if order.Status != domain.OrderStatusPending {
+			return nil
+		}
+
+		return s.repo.WithinTx(ctx, func(tx orderRepo.Repository) error {
+			if err := s.storeReservationMessage(ctx, tx, inventory.CommitItemsTopic, order.ID); err != nil {
+				return err
+			}
+
+			_, err := s.setStatus(ctx, tx, order, domain.OrderStatusReserved, "")
+			return err
+		})
+	case inventory.ReplyItemsRejected:
+		if order == nil || order.Status != domain.OrderStatusPending {
+			return nil
+		}
+
+		_, err = s.setStatus(ctx, s.repo, order, domain.OrderStatusRejected, reply.Reason)
+		return err
+	case inventory.ReplyItemsCommitted:
+		if order == nil || order.Status != domain.OrderStatusReserved {
+			return nil
+		}
+
+		_, err = s.setStatus(ctx, s.repo, order, domain.OrderStatusConfirmed, "")
+		return err
+	case inventory.ReplyItemsReleased:
+		return nil
+	default:
+		return fmt.Errorf("unknown inventory reply type %s", reply.Type)
 	}
 }
+
+func (s *service) CompactOutbox(ctx context.Context) (int, error) {
+	ctx, span := s.tracer.Start(ctx, "internal.services.order.CompactOutbox")
+	defer span.End()
+
+	return s.worker.Compact(ctx)
+}
+
+func (s *service) Shutdown(ctx context.Context) error {
+	if s.worker == nil {
+		return nil
+	}
+
+	return s.worker.Stop(ctx)
+}
+
+// setStatus stores a copy of the order with the new status, so readers of the old order don't race.
+func (s *service) setStatus(
+	ctx context.Context,
+	repo orderRepo.Repository,
+	order *domain.Order,
+	status domain.OrderStatus,
+	reason string,
+) (*domain.Order, error) {
+	updated := *order
+	updated.Status = status
+	updated.StatusReason = reason
+
+	if err := repo.Update(ctx, &updated); err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+func (s *service) storeReservationMessage(
+	ctx context.Context,
+	repo orderRepo.Repository,
+	topic string,
+	orderID string,
+) error {
+	reservationMsg := inventory.ReservationMessage{
+		OrderID: orderID,
+	}
+	reservationBytes, err := json.Marshal(reservationMsg)
+	if err != nil {
+		return err
+	}
+
+	return repo.StoreOutboxMessage(ctx, &orderRepo.OutboxMessage{
+		ID:      uuid.New().String(),
+		Topic:   topic,
+		Message: reservationBytes,
+		Headers: traceHeaders(ctx),
+	})
+}
+
+// traceHeaders captures the trace context of ctx for an outbox message, so the message continues the
+// trace of the request once the outbox worker publishes it.
+func traceHeaders(ctx context.Context) map[string]string {
+	headers := make(map[string]string)
+	tracing.InjectMessage(ctx, headers)
+
+	return headers
+}
@@ -0,0 +1,313 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go-microservices-observability/internal/adapters/queue"
+	orderRepo "go-microservices-observability/internal/adapters/repository/order"
+	"go-microservices-observability/internal/auth"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
+	"go-microservices-observability/internal/services/inventory"
+	"go-microservices-observability/pkg/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordingQueue records the messages the outbox worker publishes.
+type recordingQueue struct {
+	queue.Queue
+
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func (q *recordingQueue) Publish(ctx context.Context, topic string, message interface{}) error {
+	var reservation inventory.ReservationMessage
+	if err := json.Unmarshal(message.([]byte), &reservation); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.messages[topic] = append(q.messages[topic], reservation.OrderID)
+	return nil
+}
+
+// waitForMessage waits until a message for orderID is published to topic.
+func (q *recordingQueue) waitForMessage(t *testing.T, topic string, orderID string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if q.count(topic, orderID) > 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("no message for order %s published to %s", orderID, topic)
+}
+
+func (q *recordingQueue) count(topic string, orderID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var count int
+	for _, id := range q.messages[topic] {
+		if id == orderID {
+			count++
+		}
+	}
+
+	return count
+}
+
+type catalog struct{}
+
+func (catalog) Get(ctx context.Context, id string) (*domain.Product, error) {
+	return &domain.Product{ID: id, Quantity: 1}, nil
+}
+
+func newTestService(t *testing.T) (Service, *recordingQueue) {
+	t.Helper()
+
+	q := &recordingQueue{messages: make(map[string][]string)}
+	s := NewService(orderRepo.NewRepository(), tracing.NewTracer("test", tracetest.NewInMemoryExporter()), q, catalog{})
+	t.Cleanup(func() {
+		_ = s.Shutdown(context.Background())
+	})
+
+	return s, q
+}
+
+func createOrder(t *testing.T, s Service, ctx context.Context) *domain.Order {
+	t.Helper()
+
+	order := &domain.Order{ProductIDs: []string{"product-1"}}
+	if err := s.Create(ctx, order); err != nil {
+		t.Fatalf("failed to create order: %v", err)
+	}
+
+	return order
+}
+
+func reply(t *testing.T, s Service, orderID string, replyType inventory.ReplyType) {
+	t.Helper()
+
+	err := s.HandleInventoryReply(context.Background(), inventory.ReplyMessage{OrderID: orderID, Type: replyType})
+	if err != nil {
+		t.Fatalf("failed to handle reply %s: %v", replyType, err)
+	}
+}
+
+func assertStatus(t *testing.T, s Service, ctx context.Context, id string, want domain.OrderStatus) {
+	t.Helper()
+
+	order, err := s.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("failed to get order: %v", err)
+	}
+	if order.Status != want {
+		t.Fatalf("expected status %s, got %s", want, order.Status)
+	}
+}
+
+func TestService_ConfirmsReservedOrder(t *testing.T) {
+	t.Parallel()
+
+	s, q := newTestService(t)
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "alice"})
+	order := createOrder(t, s, ctx)
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusPending)
+	q.waitForMessage(t, inventory.DeductItemsTopic, order.ID)
+
+	reply(t, s, order.ID, inventory.ReplyItemsReserved)
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusReserved)
+	q.waitForMessage(t, inventory.CommitItemsTopic, order.ID)
+
+	// The reservation is being committed, so the order can neither be cancelled nor deleted.
+	if _, err := s.Cancel(ctx, order.ID); !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Fatalf("Cancel: expected %v, got %v", ErrInvalidStatusTransition, err)
+	}
+	if err := s.Delete(ctx, order.ID); !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Fatalf("Delete: expected %v, got %v", ErrInvalidStatusTransition, err)
+	}
+
+	reply(t, s, order.ID, inventory.ReplyItemsCommitted)
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusConfirmed)
+
+	if err := s.Delete(ctx, order.ID); err != nil {
+		t.Fatalf("failed to delete confirmed order: %v", err)
+	}
+	if q.count(inventory.ReleaseItemsTopic, order.ID) != 0 {
+		t.Fatalf("expected the reservation of a confirmed order not to be released")
+	}
+}
+
+func TestService_IgnoresDuplicateReservedReply(t *testing.T) {
+	t.Parallel()
+
+	// The service is shut down by the test to flush the outbox.
+	q := &recordingQueue{messages: make(map[string][]string)}
+	s := NewService(orderRepo.NewRepository(), tracing.NewTracer("test", tracetest.NewInMemoryExporter()), q, catalog{})
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "alice"})
+	order := createOrder(t, s, ctx)
+
+	reply(t, s, order.ID, inventory.ReplyItemsReserved)
+	q.waitForMessage(t, inventory.CommitItemsTopic, order.ID)
+
+	// The queue delivers at least once, so the reply arrives again while and after the items are committed.
+	reply(t, s, order.ID, inventory.ReplyItemsReserved)
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusReserved)
+
+	reply(t, s, order.ID, inventory.ReplyItemsCommitted)
+	reply(t, s, order.ID, inventory.ReplyItemsReserved)
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusConfirmed)
+
+	// Wait for the outbox worker, which would have published a release along with the duplicates.
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	if count := q.count(inventory.CommitItemsTopic, order.ID); count != 1 {
+		t.Fatalf("expected the reservation to be committed once, got %d commits", count)
+	}
+	if q.count(inventory.ReleaseItemsTopic, order.ID) != 0 {
+		t.Fatalf("expected the reservation not to be released for a duplicate reply")
+	}
+}
+
+func TestService_RejectsOrder(t *testing.T) {
+	t.Parallel()
+
+	s, _ := newTestService(t)
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "alice"})
+	order := createOrder(t, s, ctx)
+
+	reply(t, s, order.ID, inventory.ReplyItemsRejected)
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusRejected)
+
+	// A late reservation doesn't revive a rejected order.
+	reply(t, s, order.ID, inventory.ReplyItemsCommitted)
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusRejected)
+}
+
+func TestService_CancelReleasesLateReservation(t *testing.T) {
+	t.Parallel()
+
+	s, q := newTestService(t)
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "alice"})
+	order := createOrder(t, s, ctx)
+
+	if err := s.Delete(ctx, order.ID); !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Fatalf("Delete: expected %v, got %v", ErrInvalidStatusTransition, err)
+	}
+
+	cancelled, err := s.Cancel(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to cancel order: %v", err)
+	}
+	if cancelled.Status != domain.OrderStatusCancelled {
+		t.Fatalf("expected status %s, got %s", domain.OrderStatusCancelled, cancelled.Status)
+	}
+
+	// The items are reserved after the cancellation, so they are released instead of committed.
+	reply(t, s, order.ID, inventory.ReplyItemsReserved)
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusCancelled)
+	q.waitForMessage(t, inventory.ReleaseItemsTopic, order.ID)
+	if q.count(inventory.CommitItemsTopic, order.ID) != 0 {
+		t.Fatalf("expected the reservation of a cancelled order not to be committed")
+	}
+
+	if _, err := s.Cancel(ctx, order.ID); !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Fatalf("Cancel: expected %v, got %v", ErrInvalidStatusTransition, err)
+	}
+	if err := s.Delete(ctx, order.ID); err != nil {
+		t.Fatalf("failed to delete cancelled order: %v", err)
+	}
+}
+
+func TestService_UpdateKeepsItemsOfOrder(t *testing.T) {
+	t.Parallel()
+
+	s, q := newTestService(t)
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "alice"})
+	order := createOrder(t, s, ctx)
+	q.waitForMessage(t, inventory.DeductItemsTopic, order.ID)
+
+	if err := s.Update(ctx, &domain.Order{ID: order.ID}); !errors.Is(err, errs.ErrValidation) {
+		t.Fatalf("expected %v for an order without items, got %v", errs.ErrValidation, err)
+	}
+
+	// The inventory reserves the items of the deduct-items message stored with the order.
+	err := s.Update(ctx, &domain.Order{ID: order.ID, ProductIDs: []string{"product-2"}})
+	if !errors.Is(err, ErrItemsChanged) {
+		t.Fatalf("expected %v for changed items of a pending order, got %v", ErrItemsChanged, err)
+	}
+
+	// The status is owned by the saga and not taken from the update.
+	unchanged := &domain.Order{ID: order.ID, ProductIDs: []string{"product-1"}, Status: domain.OrderStatusConfirmed}
+	if err := s.Update(ctx, unchanged); err != nil {
+		t.Fatalf("failed to update order with the same items: %v", err)
+	}
+	assertStatus(t, s, ctx, order.ID, domain.OrderStatusPending)
+
+	reply(t, s, order.ID, inventory.ReplyItemsReserved)
+
+	err = s.Update(ctx, &domain.Order{ID: order.ID, ProductIDs: []string{"product-3"}})
+	if !errors.Is(err, ErrItemsChanged) {
+		t.Fatalf("expected %v for changed items of a reserved order, got %v", ErrItemsChanged, err)
+	}
+
+	stored, err := s.Get(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to get order: %v", err)
+	}
+	if len(stored.ProductIDs) != 1 || stored.ProductIDs[0] != "product-1" {
+		t.Fatalf("expected the items the order was created with, got %v", stored.ProductIDs)
+	}
+	if q.count(inventory.DeductItemsTopic, order.ID) != 1 {
+		t.Fatalf("expected the items to be deducted once")
+	}
+}
+
+func TestService_HidesOrdersOfOtherCustomers(t *testing.T) {
+	t.Parallel()
+
+	s, _ := newTestService(t)
+	alice := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "alice"})
+	bob := auth.WithPrincipal(context.Background(), auth.Principal{Subject: "bob"})
+	order := createOrder(t, s, alice)
+
+	_, getErr := s.Get(bob, order.ID)
+	_, cancelErr := s.Cancel(bob, order.ID)
+	results := map[string]error{
+		"Get":    getErr,
+		"Update": s.Update(bob, &domain.Order{ID: order.ID, ProductIDs: []string{"product-2"}}),
+		"Cancel": cancelErr,
+		"Delete": s.Delete(bob, order.ID),
+	}
+	for method, err := range results {
+		if !errors.Is(err, orderRepo.ErrOrderNotFound) {
+			t.Errorf("%s: expected %v, got %v", method, orderRepo.ErrOrderNotFound, err)
+		}
+	}
+
+	orders, err := s.List(bob)
+	if err != nil || len(orders) != 0 {
+		t.Fatalf("expected no orders of bob, got %v, %v", orders, err)
+	}
+
+	// The order of alice is untouched.
+	assertStatus(t, s, alice, order.ID, domain.OrderStatusPending)
+	orders, err = s.List(alice)
+	if err != nil || len(orders) != 1 || orders[0].ProductIDs[0] != "product-1" {
+		t.Fatalf("expected the order of alice, got %v, %v", orders, err)
+	}
+}
@@ -0,0 +1,451 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	userRepo "go-microservices-observability/internal/adapters/repository/user"
+	"go-microservices-observability/internal/auth"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
+	"go-microservices-observability/pkg/tracing"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials doesn't tell unknown users and wrong passwords apart, so usernames can't be probed.
+var ErrInvalidCredentials = errs.New(errs.ErrUnauthorized, "invalid username or password")
+var ErrAccountLocked = errs.New(errs.ErrUnauthorized, "account locked")
+
+const minPasswordLength = 8
+
+// Config configures the user service.
+type Config struct {
+	// MaxFailedAttempts is the number of failed authentications in a row that lock an account. Defaults
+	// to 5.
+	MaxFailedAttempts int
+	// LockoutDuration is the time a locked account rejects every authentication. Defaults to 15 minutes.
+	LockoutDuration time.Duration
+	// BcryptCost is the cost of hashing passwords. Defaults to bcrypt.DefaultCost.
+	BcryptCost int
+	// DefaultScopes are granted to new users. Defaults to orders:read and orders:write.
+	DefaultScopes []string
+	// ReservedUsernames can't be registered by anyone, only provisioned with ProvisionUser. Defaults to
+	// admin.
+	ReservedUsernames []string
+	// Signer signs the issued tokens. Defaults to a signer with a new key for the issuer "user-service".
+	Signer *auth.Signer
+	// TokenTTL is the lifetime of the issued tokens. Defaults to 15 minutes.
+	TokenTTL time.Duration
+}
+
+const (
+	defaultMaxFailedAttempts = 5
+	defaultLockoutDuration   = 15 * time.Minute
+	defaultTokenTTL          = 15 * time.Minute
+)
+
+var defaultScopes = []string{auth.ScopeOrdersRead, auth.ScopeOrdersWrite}
+
+var defaultReservedUsernames = []string{"admin"}
+
+// Token is an access token issued to a user.
+type Token struct {
+	AccessToken string
+	ExpiresAt   time.Time
+	Scopes      []string
+}
+
+type Service interface {
+	// Register creates a user with the given password. Reserved usernames can only be provisioned.
+	Register(ctx context.Context, username string, password string) (*domain.User, error)
+	// Authenticate checks the password of a user. After MaxFailedAttempts failures in a row the account is
+	// locked for LockoutDuration.
+	Authenticate(ctx context.Context, username string, password string) (*domain.User, error)
+	// ChangePassword replaces the password of a user after authenticating them with the current one.
+	ChangePassword(ctx context.Context, username string, currentPassword string, newPassword string) error
+	// IssueToken authenticates a user like Authenticate and issues a token with the requested scopes, or
+	// all scopes of the user if none are requested.
+	IssueToken(ctx context.Context, username string, password string, scopes []string) (*Token, error)
+	// ProvisionUser creates a user with the given password and scopes in addition to the default ones, e.g.
+	// auth.ScopeAdmin, including reserved usernames. An existing user is reset to the password and scopes,
+	// as it may have been registered by someone else. Tokens issued before keep their scopes.
+	ProvisionUser(ctx context.Context, username string, password string, scopes ...string) error
+	// KeySet returns the public keys the tokens are signed with.
+	KeySet(ctx context.Context) auth.JSONWebKeySet
+}
+
+type service struct {
+	repo              userRepo.Repository
+	tracer            tracing.Tracer
+	maxFailedAttempts int
+	lockoutDuration   time.Duration
+	bcryptCost        int
+	defaultScopes     []string
+	reservedUsernames []string
+	signer            *auth.Signer
+	tokenTTL          time.Duration
+	// dummyHash is compared with the passwords of unknown users, so they take as long as known users.
+	dummyHash []byte
+	// userLocks serializes the authentications and changes of a user, so concurrent failures are all
+	// counted. Different users are authenticated in parallel.
+	userLocks userLocks
+}
+
+func NewService(repo userRepo.Repository, tracer tracing.Tracer, config *Config) Service {
+	if config == nil {
+		config = &Config{}
+	}
+
+	maxFailedAttempts := config.MaxFailedAttempts
+	if maxFailedAttempts <= 0 {
+		maxFailedAttempts = defaultMaxFailedAttempts
+	}
+
+	lockoutDuration := config.LockoutDuration
+	if lockoutDuration <= 0 {
+		lockoutDuration = defaultLockoutDuration
+	}
+
+	bcryptCost := config.BcryptCost
+	if bcryptCost == 0 {
+		bcryptCost = bcrypt.DefaultCost
+	}
+
+	scopes := config.DefaultScopes
+	if scopes == nil {
+		scopes = defaultScopes
+	}
+
+	reservedUsernames := config.ReservedUsernames
+	if reservedUsernames == nil {
+		reservedUsernames = defaultReservedUsernames
+	}
+
+	signer := config.Signer
+	if signer == nil {
+		var err error
+		signer, err = auth.NewSigner("user-service")
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	tokenTTL := config.TokenTTL
+	if tokenTTL <= 0 {
+		tokenTTL = defaultTokenTTL
+	}
+
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcryptCost)
+	if err != nil {
+		panic(err)
+	}
+
+	return &service{
+		repo:              repo,
+		tracer:            tracer,
+		maxFailedAttempts: maxFailedAttempts,
+		lockoutDuration:   lockoutDuration,
+		bcryptCost:        bcryptCost,
+		defaultScopes:     scopes,
+		reservedUsernames: reservedUsernames,
+		signer:            signer,
+		tokenTTL:          tokenTTL,
+		dummyHash:         dummyHash,
+	}
+}
+
+func (s *service) Register(ctx context.Context, username string, password string) (*domain.User, error) {
+	ctx, span := s.tracer.Start(ctx, "internal.services.user.Register")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("enduser.id", username))
+
+	var validationErr errs.ValidationError
+	if username == "" {
+		validationErr.Add("username", "is required")
+	} else if slices.Contains(s.reservedUsernames, username) {
+		validationErr.Add("username", "is reserved")
+	}
+	validatePassword(&validationErr, "password", password)
+	if err := validationErr.Err(); err != nil {
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.bcryptCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	user := &domain.User{
+		Username:     username,
+		PasswordHash: hash,
+		Scopes:       slices.Clone(s.defaultScopes),
+		CreatedAt:    time.Now(),
+	}
+	if err := s.repo.Create(ctx, user); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *service) Authenticate(ctx context.Context, username string, password string) (*domain.User, error) {
+	ctx, span := s.tracer.Start(ctx, "internal.services.user.Authenticate")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("enduser.id", username))
+
+	unlock := s.userLocks.lock(username)
+	user, err := s.authenticate(ctx, username, password)
+	unlock()
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *service) ChangePassword(
+	ctx context.Context,
+	username string,
+	currentPassword string,
+	newPassword string,
+) error {
+	ctx, span := s.tracer.Start(ctx, "internal.services.user.ChangePassword")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("enduser.id", username))
+
+	var validationErr errs.ValidationError
+	validatePassword(&validationErr, "newPassword", newPassword)
+	if err := validationErr.Err(); err != nil {
+		return err
+	}
+
+	defer s.userLocks.lock(username)()
+
+	user, err := s.authenticate(ctx, username, currentPassword)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(newPassword), s.bcryptCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	user.PasswordHash = hash
+
+	return s.repo.Update(ctx, user)
+}
+
+func (s *service) IssueToken(
+	ctx context.Context,
+	username string,
+	password string,
+	scopes []string,
+) (*Token, error) {
+	ctx, span := s.tracer.Start(ctx, "internal.services.user.IssueToken")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("enduser.id", username))
+
+	unlock := s.userLocks.lock(username)
+	user, err := s.authenticate(ctx, username, password)
+	unlock()
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	if len(scopes) == 0 {
+		scopes = user.Scopes
+	}
+
+	var validationErr errs.ValidationError
+	for _, scope := range scopes {
+		if !slices.Contains(user.Scopes, scope) {
+			validationErr.Add("scope", scope+" is not granted to the user")
+		}
+	}
+	if err := validationErr.Err(); err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.StringSlice("enduser.scope", scopes))
+
+	accessToken, expiresAt, err := s.signer.Sign(auth.Principal{Subject: user.Username, Scopes: scopes}, s.tokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		AccessToken: accessToken,
+		ExpiresAt:   expiresAt,
+		Scopes:      scopes,
+	}, nil
+}
+
+func (s *service) ProvisionUser(ctx context.Context, username string, password string, scopes ...string) error {
+	ctx, span := s.tracer.Start(ctx, "internal.services.user.ProvisionUser")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("enduser.id", username), attribute.StringSlice("enduser.scope", scopes))
+
+	var validationErr errs.ValidationError
+	validatePassword(&validationErr, "password", password)
+	if err := validationErr.Err(); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.bcryptCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	// Serialized with the authentications, which update the same user.
+	defer s.userLocks.lock(username)()
+
+	user, err := s.repo.Get(ctx, username)
+	if errors.Is(err, userRepo.ErrUserNotFound) {
+		user = &domain.User{
+			Username:     username,
+			PasswordHash: hash,
+			Scopes:       slices.Clone(s.defaultScopes),
+			CreatedAt:    time.Now(),
+		}
+		user.Scopes = appendScopes(user.Scopes, scopes)
+
+		return s.repo.Create(ctx, user)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The existing user may have been registered by someone else, so it only keeps its name.
+	user.PasswordHash = hash
+	user.FailedAttempts = 0
+	user.LockedUntil = time.Time{}
+	user.Scopes = appendScopes(slices.Clone(s.defaultScopes), scopes)
+
+	return s.repo.Update(ctx, user)
+}
+
+func (s *service) KeySet(ctx context.Context) auth.JSONWebKeySet {
+	return s.signer.KeySet()
+}
+
+// authenticate checks the password of a user and records the outcome for the lockout. It must be called
+// with the lock of the user held.
+func (s *service) authenticate(ctx context.Context, username string, password string) (*domain.User, error) {
+	user, err := s.repo.Get(ctx, username)
+	if errors.Is(err, userRepo.ErrUserNotFound) {
+		_ = bcrypt.CompareHashAndPassword(s.dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.Before(user.LockedUntil) {
+		return nil, lockedError(user)
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)); err != nil {
+		user.FailedAttempts++
+		authErr := ErrInvalidCredentials
+		if user.FailedAttempts >= s.maxFailedAttempts {
+			user.FailedAttempts = 0
+			user.LockedUntil = now.Add(s.lockoutDuration)
+			authErr = lockedError(user)
+		}
+
+		if err := s.repo.Update(ctx, user); err != nil {
+			return nil, err
+		}
+
+		return nil, authErr
+	}
+
+	if user.FailedAttempts > 0 {
+		user.FailedAttempts = 0
+		if err := s.repo.Update(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// userLocks holds a mutex per user that is in use. The mutex of a user is dropped once nobody holds or
+// waits for it, so the locks don't grow with the number of users.
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	// refs is the number of callers holding or waiting for the lock.
+	refs int
+}
+
+// lock locks the user and returns the function that unlocks it.
+func (l *userLocks) lock(username string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*userLock)
+	}
+	ul, ok := l.locks[username]
+	if !ok {
+		ul = &userLock{}
+		l.locks[username] = ul
+	}
+	ul.refs++
+	l.mu.Unlock()
+
+	ul.Lock()
+
+	return func() {
+		ul.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		ul.refs--
+		if ul.refs == 0 {
+			delete(l.locks, username)
+		}
+	}
+}
+
+// appendScopes appends the scopes that are missing in granted.
+func appendScopes(granted []string, scopes []string) []string {
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	return granted
+}
+
+func lockedError(user *domain.User) error {
+	return fmt.Errorf("%w until %s", ErrAccountLocked, user.LockedUntil.UTC().Format(time.RFC3339))
+}
+
+func validatePassword(validationErr *errs.ValidationError, field string, password string) {
+	// bcrypt ignores everything after 72 bytes.
+	if len(password) < minPasswordLength {
+		validationErr.Add(field, fmt.Sprintf("must be at least %d characters long", minPasswordLength))
+	} else if len(password) > 72 {
+		validationErr.Add(field, "must be at most 72 bytes long")
+	}
+}
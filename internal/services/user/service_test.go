@@ -0,0 +1,282 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	userRepo "go-microservices-observability/internal/adapters/repository/user"
+	"go-microservices-observability/internal/domain"
+	"go-microservices-observability/internal/errs"
+	"go-microservices-observability/pkg/tracing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestService(t *testing.T) Service {
+	t.Helper()
+
+	return NewService(userRepo.NewRepository(), tracing.NewTracer("test", tracetest.NewInMemoryExporter()), &Config{
+		MaxFailedAttempts: 3,
+		LockoutDuration:   time.Hour,
+		BcryptCost:        bcrypt.MinCost,
+	})
+}
+
+func TestService_Authenticate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestService(t)
+	if _, err := s.Register(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	if _, err := s.Authenticate(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("expected the password to be accepted, got %v", err)
+	}
+
+	for _, username := range []string{"alice", "bob"} {
+		_, err := s.Authenticate(ctx, username, "wrong password")
+		if !errors.Is(err, ErrInvalidCredentials) || !errors.Is(err, errs.ErrUnauthorized) {
+			t.Fatalf("%s: expected %v, got %v", username, ErrInvalidCredentials, err)
+		}
+	}
+}
+
+func TestService_LocksAccountAfterFailures(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestService(t)
+	if _, err := s.Register(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	// A success resets the failures.
+	for range 2 {
+		_, _ = s.Authenticate(ctx, "alice", "wrong password")
+	}
+	if _, err := s.Authenticate(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("expected the password to be accepted, got %v", err)
+	}
+
+	for range 2 {
+		if _, err := s.Authenticate(ctx, "alice", "wrong password"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("expected %v, got %v", ErrInvalidCredentials, err)
+		}
+	}
+	if _, err := s.Authenticate(ctx, "alice", "wrong password"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("expected the third failure to lock the account, got %v", err)
+	}
+
+	// A locked account rejects the correct password, too.
+	if _, err := s.Authenticate(ctx, "alice", "correct horse"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("expected %v, got %v", ErrAccountLocked, err)
+	}
+}
+
+func TestService_CountsConcurrentFailures(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestService(t)
+	if _, err := s.Register(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan error, 6)
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Authenticate(ctx, "alice", "wrong password")
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	// The third failure locks the account, the later attempts find it locked.
+	locked := 0
+	for err := range results {
+		if errors.Is(err, ErrAccountLocked) {
+			locked++
+		}
+	}
+	if locked != 4 {
+		t.Fatalf("expected 4 attempts to find the account locked, got %d", locked)
+	}
+}
+
+func TestUserLocks(t *testing.T) {
+	t.Parallel()
+
+	var locks userLocks
+	unlockAlice := locks.lock("alice")
+
+	// Other users are not blocked by alice.
+	done := make(chan struct{})
+	go func() {
+		locks.lock("bob")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected bob not to wait for the lock of alice")
+	}
+
+	acquired := make(chan func())
+	go func() {
+		acquired <- locks.lock("alice")
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected the lock of alice to be held")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	unlockAlice()
+	(<-acquired)()
+
+	if len(locks.locks) != 0 {
+		t.Fatalf("expected unused locks to be dropped, got %d", len(locks.locks))
+	}
+}
+
+func TestService_ChangePassword(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestService(t)
+	if _, err := s.Register(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	if err := s.ChangePassword(ctx, "alice", "wrong password", "battery staple"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected %v, got %v", ErrInvalidCredentials, err)
+	}
+	if err := s.ChangePassword(ctx, "alice", "correct horse", "short"); !errors.Is(err, errs.ErrValidation) {
+		t.Fatalf("expected %v, got %v", errs.ErrValidation, err)
+	}
+	if err := s.ChangePassword(ctx, "alice", "correct horse", "battery staple"); err != nil {
+		t.Fatalf("failed to change password: %v", err)
+	}
+
+	if _, err := s.Authenticate(ctx, "alice", "correct horse"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected the old password to be rejected, got %v", err)
+	}
+	if _, err := s.Authenticate(ctx, "alice", "battery staple"); err != nil {
+		t.Fatalf("expected the new password to be accepted, got %v", err)
+	}
+}
+
+func TestService_Register(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestService(t)
+
+	var validationErr *errs.ValidationError
+	if _, err := s.Register(ctx, "", "short"); !errors.As(err, &validationErr) || len(validationErr.Fields) != 2 {
+		t.Fatalf("expected 2 invalid fields, got %v", err)
+	}
+
+	if _, err := s.Register(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if _, err := s.Register(ctx, "alice", "battery staple"); !errors.Is(err, userRepo.ErrUserAlreadyExists) {
+		t.Fatalf("expected %v, got %v", userRepo.ErrUserAlreadyExists, err)
+	}
+
+	_, err := s.Register(ctx, "admin", "correct horse")
+	if !errors.As(err, &validationErr) || len(validationErr.Fields) != 1 || validationErr.Fields[0].Field != "username" {
+		t.Fatalf("expected the reserved username to be rejected, got %v", err)
+	}
+}
+
+func TestService_ProvisionUserTakesOverExistingUser(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	repo := userRepo.NewRepository()
+	s := NewService(repo, tracing.NewTracer("test", tracetest.NewInMemoryExporter()), &Config{
+		BcryptCost: bcrypt.MinCost,
+	})
+
+	// The admin user was registered by someone else, e.g. before the username was reserved.
+	hash, err := bcrypt.GenerateFromPassword([]byte("attacker password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	err = repo.Create(ctx, &domain.User{Username: "admin", PasswordHash: hash, Scopes: []string{"orders:read"}})
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	if err := s.ProvisionUser(ctx, "admin", "operator password", "admin"); err != nil {
+		t.Fatalf("failed to provision user: %v", err)
+	}
+
+	_, err = s.IssueToken(ctx, "admin", "attacker password", []string{"admin"})
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected the previous password to be rejected with %v, got %v", ErrInvalidCredentials, err)
+	}
+	token, err := s.IssueToken(ctx, "admin", "operator password", []string{"admin"})
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	if !slices.Equal(token.Scopes, []string{"admin"}) {
+		t.Fatalf("expected the provisioned scope, got %v", token.Scopes)
+	}
+}
+
+func TestService_IssueToken(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestService(t)
+	if _, err := s.Register(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+
+	token, err := s.IssueToken(ctx, "alice", "correct horse", nil)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	if !slices.Equal(token.Scopes, []string{"orders:read", "orders:write"}) {
+		t.Fatalf("expected the default scopes, got %v", token.Scopes)
+	}
+
+	token, err = s.IssueToken(ctx, "alice", "correct horse", []string{"orders:read"})
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	if !slices.Equal(token.Scopes, []string{"orders:read"}) {
+		t.Fatalf("expected the requested scopes, got %v", token.Scopes)
+	}
+
+	if _, err := s.IssueToken(ctx, "alice", "correct horse", []string{"admin"}); !errors.Is(err, errs.ErrValidation) {
+		t.Fatalf("expected %v, got %v", errs.ErrValidation, err)
+	}
+
+	if err := s.ProvisionUser(ctx, "alice", "correct horse", "admin"); err != nil {
+		t.Fatalf("failed to provision user: %v", err)
+	}
+	token, err = s.IssueToken(ctx, "alice", "correct horse", []string{"admin"})
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	if !slices.Equal(token.Scopes, []string{"admin"}) {
+		t.Fatalf("expected the granted scope, got %v", token.Scopes)
+	}
+	if _, err := s.IssueToken(ctx, "alice", "wrong password", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected %v, got %v", ErrInvalidCredentials, err)
+	}
+}
@@ -15,6 +15,7 @@ const readTimeout = 5 * time.Second
 
 type Server struct {
 	httpServer *http.Server
+	mux        *http.ServeMux
 }
 
 func NewServer(port int) *Server {
@@ -43,9 +44,15 @@ func NewServer(port int) *Server {
 			ReadTimeout:  readTimeout,
 			WriteTimeout: writeTimeout,
 		},
+		mux: mux,
 	}
 }
 
+// Handle registers an additional diagnostics handler for the given pattern.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
 func (s *Server) Start() error {
 	return s.httpServer.ListenAndServe()
 }
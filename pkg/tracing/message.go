@@ -0,0 +1,24 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// messagePropagator writes the W3C traceparent, tracestate and baggage headers of a message.
+var messagePropagator = propagation.NewCompositeTextMapPropagator(
+	propagation.TraceContext{},
+	propagation.Baggage{},
+)
+
+// InjectMessage writes the span context and baggage of ctx into the headers of a message.
+func InjectMessage(ctx context.Context, headers map[string]string) {
+	messagePropagator.Inject(ctx, propagation.MapCarrier(headers))
+}
+
+// ExtractMessage returns a copy of ctx with the span context of the message headers as remote parent and
+// their baggage.
+func ExtractMessage(ctx context.Context, headers map[string]string) context.Context {
+	return messagePropagator.Extract(ctx, propagation.MapCarrier(headers))
+}
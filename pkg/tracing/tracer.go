@@ -18,7 +18,7 @@ import (
 //go:generate mockgen -destination=./mock/tracer.go -source=./tracer.go
 type Tracer interface {
 	// Start a new span.
-	Start(ctx context.Context, spanName string) (context.Context, oteltrace.Span)
+	Start(ctx context.Context, spanName string, opts ...oteltrace.SpanStartOption) (context.Context, oteltrace.Span)
 	StartSpanFromHeader(ctx context.Context, h http.Header, spanName string) (context.Context, oteltrace.Span)
 	StartSpanWithLinkToParent(
 		ctx context.Context,
@@ -101,8 +101,12 @@ func (t tracer) StartSpanWithContext(
 }
 
 // Start a new span.
-func (t tracer) Start(ctx context.Context, spanName string) (context.Context, oteltrace.Span) {
-	return t.tracer.Start(ctx, spanName)
+func (t tracer) Start(
+	ctx context.Context,
+	spanName string,
+	opts ...oteltrace.SpanStartOption,
+) (context.Context, oteltrace.Span) {
+	return t.tracer.Start(ctx, spanName, opts...)
 }
 
 func (t tracer) Shutdown() error {